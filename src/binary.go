@@ -0,0 +1,207 @@
+package main
+
+import (
+	"./neuralnet"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// A stream starting with binaryMagic carries length-prefixed binary frames instead of JSON text, which saves
+// formatting and parsing large samples. The worker acknowledges by starting its output with the same magic.
+//
+// Every frame is a little-endian uint32 length followed by that many bytes of a JSON header, then two matrix blocks.
+// A request frame has a Request header and the X and T blocks, a response frame has a Result (or error) header and
+// the Predicted and Hidden blocks, unless their rows differ in length. A matrix block is a uint32 row count, a uint32
+// column count and the float64 values row by row. A block with no rows stands for a missing matrix - in requests, X
+// and T in the header are used then.
+var binaryMagic = []byte("NNSB\x01")
+
+const (
+	maxBinaryFloats = 1 << 28
+	maxBinaryHeader = 1 << 26 // bytes, the samples belong in the matrix blocks
+)
+
+func isBinaryStream(in *bufio.Reader) (bool, error) {
+	prefix, err := in.Peek(len(binaryMagic))
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(prefix, binaryMagic), nil
+}
+
+// serveBinary reads binary request frames from in, which must start with binaryMagic, until EOF.
+func serveBinary(in *bufio.Reader, w io.Writer, workers int, ordered bool) {
+	if _, err := in.Discard(len(binaryMagic)); err != nil {
+		return
+	}
+	if _, err := w.Write(binaryMagic); err != nil {
+		return
+	}
+
+	ws := newWorkspace()
+	out := newResponseWriter(&frameEncoder{w})
+	d := newDispatcher(out, workers, ordered)
+	defer d.wait()
+
+	for {
+		header, x, t, err := readFrame(in)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			// frame boundaries are lost, there is no way to carry on
+			response := ErrorResponse{Error: ErrorInfo{Code: DecodeError, Message: err.Error()}}
+			d.submit(func() interface{} { return response })
+			return
+		}
+
+		request := Request{}
+		if err := json.Unmarshal(header, &request); err != nil {
+			response := errorResponse(decodeError(err))
+			response.Id = request.Id
+			d.submit(func() interface{} { return response })
+			continue
+		}
+		if x != nil {
+			request.X = make(neuralnet.XSample, len(x))
+			for i := range x {
+				request.X[i] = x[i]
+			}
+		}
+		if t != nil {
+			request.T = make(neuralnet.YSample, len(t))
+			for i := range t {
+				request.T[i] = t[i]
+			}
+		}
+
+		if request.Command == CancelCommand {
+			out.write(ws.respond(context.Background(), request, nil)) // bypasses the queue, so it reaches running fits right away
+			continue
+		}
+		d.submit(func() interface{} { return ws.respond(context.Background(), request, out.write) })
+	}
+}
+
+func readFrame(in io.Reader) (header []byte, x [][]float64, t [][]float64, err error) {
+	var length uint32
+	if err = binary.Read(in, binary.LittleEndian, &length); err != nil {
+		return // a clean io.EOF between frames ends the stream
+	}
+	if length > maxBinaryHeader {
+		return nil, nil, nil, fmt.Errorf("header of %d bytes is too large", length)
+	}
+	header = make([]byte, length)
+	if _, err = io.ReadFull(in, header); err != nil {
+		return nil, nil, nil, unexpectedEOF(err)
+	}
+	if x, err = readMatrix(in); err != nil {
+		return nil, nil, nil, err
+	}
+	if t, err = readMatrix(in); err != nil {
+		return nil, nil, nil, err
+	}
+	return header, x, t, nil
+}
+
+func readMatrix(in io.Reader) ([][]float64, error) {
+	var shape [2]uint32
+	if err := binary.Read(in, binary.LittleEndian, &shape); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	rows, cols := int(shape[0]), int(shape[1])
+	if rows == 0 {
+		return nil, nil
+	}
+	if uint64(rows)*uint64(cols) > maxBinaryFloats {
+		return nil, fmt.Errorf("matrix of %d x %d is too large", rows, cols)
+	}
+
+	values := make([]float64, rows*cols)
+	if err := binary.Read(in, binary.LittleEndian, values); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	matrix := make([][]float64, rows)
+	for i := range matrix {
+		matrix[i] = values[i*cols : (i+1)*cols : (i+1)*cols]
+	}
+	return matrix, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// frameEncoder writes responses as binary frames, moving Predicted and Hidden of results into matrix blocks.
+// Ragged ones, e.g. of recurrent networks predicting every step of sequences of different lengths, stay in the
+// header instead.
+type frameEncoder struct {
+	w io.Writer
+}
+
+func (enc *frameEncoder) Encode(response interface{}) error {
+	var predicted, hidden [][]float64
+	if result, ok := response.(*Result); ok {
+		header := *result
+		for _, y := range header.Predicted {
+			predicted = append(predicted, y)
+		}
+		if rectangular(predicted) {
+			header.Predicted = nil
+		} else {
+			predicted = nil
+		}
+		if rectangular(header.Hidden) {
+			hidden, header.Hidden = header.Hidden, nil
+		}
+		response = &header
+	}
+
+	header, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, uint32(len(header)))
+	buf.Write(header)
+	if err := writeMatrix(buf, predicted); err != nil {
+		return err
+	}
+	if err := writeMatrix(buf, hidden); err != nil {
+		return err
+	}
+	_, err = enc.w.Write(buf.Bytes())
+	return err
+}
+
+func rectangular(matrix [][]float64) bool {
+	for _, row := range matrix {
+		if len(row) != len(matrix[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+func writeMatrix(buf *bytes.Buffer, matrix [][]float64) error {
+	cols := 0
+	if len(matrix) > 0 {
+		cols = len(matrix[0])
+	}
+	binary.Write(buf, binary.LittleEndian, [2]uint32{uint32(len(matrix)), uint32(cols)})
+	for i, row := range matrix {
+		if len(row) != cols {
+			return fmt.Errorf("row %d has %d columns instead of %d", i, len(row), cols)
+		}
+		binary.Write(buf, binary.LittleEndian, row)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+func TestBinaryStreamsRoundTrip(t *testing.T) {
+	in := &bytes.Buffer{}
+	in.Write(binaryMagic)
+	writeTestFrame(t, in, `{"Id": "fit", "ShouldFit": true, "Order": {"D":2,"M":[4],"K":3}}`, [][]float64{{1, 1}, {1, 2}}, [][]float64{{1, 2, 3}, {3, 2, 1}})
+	writeTestFrame(t, in, `{"Id": "bad", "Order": {"D":2,"M":[],"K":3}}`, [][]float64{{1, 1}}, nil)
+	writeTestFrame(t, in, `{"Id": "json", "Order": {"D":2,"M":[4],"K":3}, "X": [[1, 1]]}`, nil, nil)
+
+	reader := bufio.NewReader(in)
+	if binary, err := isBinaryStream(reader); err != nil || !binary {
+		t.Fatalf("expected a binary stream: %v", err)
+	}
+	out := &bytes.Buffer{}
+	serveBinary(reader, out, 1, true)
+
+	magic := make([]byte, len(binaryMagic))
+	if _, err := io.ReadFull(out, magic); err != nil || !bytes.Equal(magic, binaryMagic) {
+		t.Fatalf("expected the stream to be acknowledged, got %q", magic)
+	}
+
+	header, predicted, hidden, err := readFrame(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := Result{}
+	if err := json.Unmarshal(header, &result); err != nil || result.Id != "fit" || len(result.Wts) != 27 || result.Predicted != nil {
+		t.Errorf("expected a result header without predictions, got %s", header)
+	}
+	if len(predicted) != 2 || len(predicted[0]) != 3 || len(hidden) != 2 || len(hidden[0]) != 4 {
+		t.Errorf("expected 2x3 predictions and 2x4 hidden units, got %v and %v", predicted, hidden)
+	}
+	viaJSON := runServeJSON(t, `{"Id": "fit", "ShouldFit": true, "Order": {"D":2,"M":[4],"K":3}, "X": [[1, 1], [1, 2]], "T": [[1, 2, 3], [3, 2, 1]]}`, 1, false)
+	expected := Result{}
+	if err := json.Unmarshal(viaJSON[0], &expected); err != nil {
+		t.Fatal(err)
+	}
+	for i := range expected.Predicted {
+		for k := range expected.Predicted[i] {
+			if predicted[i][k] != expected.Predicted[i][k] {
+				t.Errorf("prediction [%d][%d] differs from the JSON one: %f != %f", i, k, predicted[i][k], expected.Predicted[i][k])
+			}
+		}
+	}
+
+	header, predicted, hidden, err = readFrame(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectErrorResponse(t, header, "bad", InvalidInput, "Order.M")
+	if predicted != nil || hidden != nil {
+		t.Errorf("expected no blocks for an error, got %v and %v", predicted, hidden)
+	}
+
+	header, predicted, _, err = readFrame(out)
+	if err != nil || len(predicted) != 1 {
+		t.Errorf("expected X from the JSON header to be used, got %s %v: %v", header, predicted, err)
+	}
+
+	if _, _, _, err := readFrame(out); err != io.EOF {
+		t.Errorf("expected the end of the stream, got %v", err)
+	}
+}
+
+func TestBinaryStreamKeepsRaggedResultsInHeader(t *testing.T) {
+	in := &bytes.Buffer{}
+	in.Write(binaryMagic)
+	writeTestFrame(t, in, `{"Id": "r", "Order": {"D":1,"M":[2],"K":1,"Recurrent":{"EveryStep":true}}, "XSequences": [[[1],[2]], [[3]]], "TSequences": [[[1],[2]], [[3]]]}`, nil, nil)
+
+	out := &bytes.Buffer{}
+	serveBinary(bufio.NewReader(in), out, 1, false)
+	out.Next(len(binaryMagic))
+
+	header, predicted, hidden, err := readFrame(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := Result{}
+	if err := json.Unmarshal(header, &result); err != nil || result.Id != "r" {
+		t.Fatalf("expected a result, got %s", header)
+	}
+	if len(result.Predicted) != 2 || len(result.Predicted[0]) != 2 || len(result.Predicted[1]) != 1 || len(result.Hidden) != 2 || len(result.Hidden[1]) != 2 {
+		t.Errorf("expected the outputs of every step in the header, got %s", header)
+	}
+	if predicted != nil || hidden != nil {
+		t.Errorf("expected no blocks for ragged results, got %v and %v", predicted, hidden)
+	}
+}
+
+func TestBinaryStreamStopsOnTruncatedFrame(t *testing.T) {
+	in := &bytes.Buffer{}
+	in.Write(binaryMagic)
+	binary.Write(in, binary.LittleEndian, uint32(100))
+	in.WriteString(`{"Id": "cut"`)
+
+	out := &bytes.Buffer{}
+	serveBinary(bufio.NewReader(in), out, 1, false)
+	out.Next(len(binaryMagic))
+
+	header, _, _, err := readFrame(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectErrorResponse(t, header, "", DecodeError, "")
+}
+
+func TestBinaryStreamRefusesOversizedHeader(t *testing.T) {
+	in := &bytes.Buffer{}
+	in.Write(binaryMagic)
+	binary.Write(in, binary.LittleEndian, uint32(0xffffffff))
+
+	out := &bytes.Buffer{}
+	serveBinary(bufio.NewReader(in), out, 1, false)
+	out.Next(len(binaryMagic))
+
+	header, _, _, err := readFrame(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectErrorResponse(t, header, "", DecodeError, "")
+}
+
+func writeTestFrame(t *testing.T, w *bytes.Buffer, header string, x [][]float64, y [][]float64) {
+	binary.Write(w, binary.LittleEndian, uint32(len(header)))
+	w.WriteString(header)
+	if err := writeMatrix(w, x); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMatrix(w, y); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// encoder writes responses in the wire format of the stream, e.g. a *json.Encoder.
+type encoder interface {
+	Encode(v interface{}) error
+}
+
+// responseWriter serializes responses written from concurrent requests.
+type responseWriter struct {
+	mu  sync.Mutex
+	enc encoder
+}
+
+func newResponseWriter(enc encoder) *responseWriter {
+	return &responseWriter{enc: enc}
+}
+
+// write encodes the response, unless it is nil - e.g. for JSON-RPC notifications.
+func (out *responseWriter) write(response interface{}) {
+	if response == nil {
+		return
+	}
+
+	out.mu.Lock()
+	defer out.mu.Unlock()
+
+	if err := out.enc.Encode(response); err != nil {
+		// e.g. NaN or Inf in the result, which JSON can't represent
+		if err := out.enc.Encode(encodingFailure(response, err)); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func encodingFailure(response interface{}, err error) interface{} {
+	info := internalError(fmt.Sprintf("can't encode result: %v", err))
+	switch r := response.(type) {
+	case rpcResponse:
+		return rpcErrorResponse(r.Id, info)
+	case []rpcResponse:
+		return rpcErrorResponse(nil, info)
+	default:
+		return ErrorResponse{responseId(response), info}
+	}
+}
+
+func responseId(response interface{}) string {
+	switch r := response.(type) {
+	case *Result:
+		return r.Id
+	case ErrorResponse:
+		return r.Id
+	default:
+		return ""
+	}
+}
+
+// dispatcher serves requests on a bounded pool of workers. Requests wait in a queue for a free worker, so that
+// reading the input never waits for them. In ordered mode the responses are written in submission order,
+// otherwise as soon as they are ready.
+type dispatcher struct {
+	out       *responseWriter
+	queued    *jobQueue
+	unwritten *jobQueue
+	workers   sync.WaitGroup
+	written   chan struct{}
+}
+
+type job struct {
+	serve func() interface{}
+	done  chan interface{}
+}
+
+func newDispatcher(out *responseWriter, workers int, ordered bool) *dispatcher {
+	d := &dispatcher{out: out, queued: newJobQueue()}
+	if ordered {
+		d.unwritten = newJobQueue()
+		d.written = make(chan struct{})
+		go func() {
+			for j, ok := d.unwritten.pop(); ok; j, ok = d.unwritten.pop() {
+				out.write(<-j.done)
+			}
+			close(d.written)
+		}()
+	}
+	d.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+func (d *dispatcher) work() {
+	defer d.workers.Done()
+	for j, ok := d.queued.pop(); ok; j, ok = d.queued.pop() {
+		response := j.serve()
+		if j.done != nil {
+			j.done <- response
+		} else {
+			d.out.write(response)
+		}
+	}
+}
+
+// submit queues the request for the next free worker, without waiting for it.
+func (d *dispatcher) submit(serve func() interface{}) {
+	j := &job{serve: serve}
+	if d.unwritten != nil {
+		j.done = make(chan interface{}, 1)
+		d.unwritten.push(j)
+	}
+	d.queued.push(j)
+}
+
+// wait blocks until every submitted request is answered, then stops the workers.
+func (d *dispatcher) wait() {
+	d.queued.close()
+	d.workers.Wait()
+	if d.unwritten != nil {
+		d.unwritten.close()
+		<-d.written
+	}
+}
+
+// jobQueue is an unbounded FIFO of jobs.
+type jobQueue struct {
+	mu     sync.Mutex
+	ready  *sync.Cond
+	jobs   []*job
+	closed bool
+}
+
+func newJobQueue() *jobQueue {
+	q := &jobQueue{}
+	q.ready = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *jobQueue) push(j *job) {
+	q.mu.Lock()
+	q.jobs = append(q.jobs, j)
+	q.mu.Unlock()
+	q.ready.Signal()
+}
+
+// pop waits for the next job. It reports false once the queue is closed and empty.
+func (q *jobQueue) pop() (*job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.jobs) == 0 && !q.closed {
+		q.ready.Wait()
+	}
+	if len(q.jobs) == 0 {
+		return nil, false
+	}
+	j := q.jobs[0]
+	q.jobs[0] = nil
+	q.jobs = q.jobs[1:]
+	return j, true
+}
+
+func (q *jobQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.ready.Broadcast()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"./neuralnet"
+	"encoding/json"
+)
+
+const (
+	DecodeError   = "decode_error"
+	InvalidInput  = "invalid_input"
+	InternalError = "internal_error"
+)
+
+// ErrorResponse is written in place of a Result when a request can't be served.
+type ErrorResponse struct {
+	Id    string `json:",omitempty"`
+	Error ErrorInfo
+}
+
+type ErrorInfo struct {
+	Code    string
+	Message string
+	Field   string `json:",omitempty"`
+	// Problems lists every invalid value found by validation, Field names the first of them.
+	Problems []Problem `json:",omitempty"`
+}
+
+// Problem locates one invalid value. Row and Col index into X, T or Wts, when the problem is with a single value.
+type Problem struct {
+	Field   string
+	Row     *int `json:",omitempty"`
+	Col     *int `json:",omitempty"`
+	Message string
+}
+
+func invalidInput(message string, field string) ErrorInfo {
+	return ErrorInfo{Code: InvalidInput, Message: message, Field: field}
+}
+
+func internalError(message string) ErrorInfo {
+	return ErrorInfo{Code: InternalError, Message: message}
+}
+
+func errorResponse(err error) ErrorResponse {
+	switch e := err.(type) {
+	case ErrorInfo:
+		return ErrorResponse{"", e}
+	case *neuralnet.InputError:
+		return ErrorResponse{"", invalidInput(e.Message, e.Field)}
+	case neuralnet.InputErrors:
+		info := invalidInput(e.Error(), e[0].Field)
+		for _, p := range e {
+			info.Problems = append(info.Problems, problemOf(p))
+		}
+		return ErrorResponse{"", info}
+	default:
+		return ErrorResponse{"", internalError(err.Error())}
+	}
+}
+
+func problemOf(e *neuralnet.InputError) Problem {
+	p := Problem{Field: e.Field, Message: e.Message}
+	if e.Row >= 0 {
+		row := e.Row
+		p.Row = &row
+	}
+	if e.Col >= 0 {
+		col := e.Col
+		p.Col = &col
+	}
+	return p
+}
+
+func (e ErrorInfo) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func decodeError(err error) ErrorInfo {
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+		return ErrorInfo{Code: DecodeError, Message: typeErr.Error(), Field: typeErr.Field}
+	}
+	return ErrorInfo{Code: DecodeError, Message: err.Error()}
+}
@@ -0,0 +1,158 @@
+package neuralnet
+
+import "math"
+
+// Activation names the activation function of a hidden layer in NNOrder.Activations.
+type Activation string
+
+const (
+	Tanh      Activation = "tanh"
+	Logistic  Activation = "logistic"
+	ReLU      Activation = "relu"
+	LeakyReLU Activation = "leaky_relu"
+	ELU       Activation = "elu"
+	Softplus  Activation = "softplus"
+	GELU      Activation = "gelu"
+	Linear    Activation = "linear"
+)
+
+const leakyReLUSlope = 0.01
+
+type activationFunction struct {
+	h      func(float64) float64
+	h_prim func(float64) float64
+}
+
+var activationFunctions = map[Activation]activationFunction{
+	Tanh:      {math.Tanh, tanhDerivative},
+	Logistic:  {sigmoid, sigmoidDerivative},
+	ReLU:      {relu, reluDerivative},
+	LeakyReLU: {leakyReLU, leakyReLUDerivative},
+	ELU:       {elu, eluDerivative},
+	Softplus:  {softplus, sigmoid},
+	GELU:      {gelu, geluDerivative},
+	Linear:    {identity, one},
+}
+
+// activationOf returns the activation of hidden layer l, tanh unless the order names another one.
+func (order *NNOrder) activationOf(l int) Activation {
+	if len(order.Activations) == 0 {
+		return Tanh
+	}
+	return order.Activations[l]
+}
+
+func identity(x float64) float64 {
+	return x
+}
+
+func one(x float64) float64 {
+	return 1
+}
+
+func relu(x float64) float64 {
+	return math.Max(x, 0)
+}
+
+func reluDerivative(x float64) float64 {
+	if x > 0 {
+		return 1
+	}
+	return 0
+}
+
+func leakyReLU(x float64) float64 {
+	if x > 0 {
+		return x
+	}
+	return leakyReLUSlope * x
+}
+
+func leakyReLUDerivative(x float64) float64 {
+	if x > 0 {
+		return 1
+	}
+	return leakyReLUSlope
+}
+
+func elu(x float64) float64 {
+	if x > 0 {
+		return x
+	}
+	return math.Expm1(x)
+}
+
+func eluDerivative(x float64) float64 {
+	if x > 0 {
+		return 1
+	}
+	return math.Exp(x)
+}
+
+// softplus is log(1 + e^x), computed so that it doesn't overflow for large x.
+func softplus(x float64) float64 {
+	return math.Max(x, 0) + math.Log1p(math.Exp(-math.Abs(x)))
+}
+
+// gelu is x times the standard normal CDF of x.
+func gelu(x float64) float64 {
+	return x * normalCDF(x)
+}
+
+func geluDerivative(x float64) float64 {
+	return normalCDF(x) + x*math.Exp(-x*x/2)/math.Sqrt(2*math.Pi)
+}
+
+func normalCDF(x float64) float64 {
+	return (1 + math.Erf(x/math.Sqrt2)) / 2
+}
+
+// elementwise makes an output activation applying f to each unit on its own.
+func elementwise(f func(float64) float64) func([]float64) YVector {
+	return func(a []float64) YVector {
+		return mapOverVector(a, f)
+	}
+}
+
+// elementwisePrim is the Jacobian of elementwise(f), given the derivative of f.
+func elementwisePrim(fPrim func(float64) float64) func([]float64) [][]float64 {
+	return func(a []float64) [][]float64 {
+		jacobian := make([][]float64, len(a))
+		for k := range jacobian {
+			jacobian[k] = make([]float64, len(a))
+			jacobian[k][k] = fPrim(a[k])
+		}
+		return jacobian
+	}
+}
+
+// softmax shifts the activations by their maximum before exponentiating, so that none of them overflows.
+func softmax(a []float64) YVector {
+	max := math.Inf(-1)
+	for _, v := range a {
+		max = math.Max(max, v)
+	}
+	y := make(YVector, len(a))
+	sum := 0.0
+	for k, v := range a {
+		y[k] = math.Exp(v - max)
+		sum += y[k]
+	}
+	for k := range y {
+		y[k] /= sum
+	}
+	return y
+}
+
+func softmaxPrim(a []float64) [][]float64 {
+	y := softmax(a)
+	jacobian := make([][]float64, len(a))
+	for k := range jacobian {
+		jacobian[k] = make([]float64, len(a))
+		for j := range jacobian[k] {
+			jacobian[k][j] = -y[k] * y[j]
+		}
+		jacobian[k][k] += y[k]
+	}
+	return jacobian
+}
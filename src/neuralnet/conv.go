@@ -0,0 +1,275 @@
+package neuralnet
+
+import "fmt"
+
+// Pooling names how a pooling layer in NNOrder.Convolutions summarizes its windows.
+type Pooling string
+
+const (
+	MaxPooling     Pooling = "max"
+	AveragePooling Pooling = "average"
+)
+
+// ConvLayer is a 1D convolution over all channels of its input, or, if Pool is set, a pooling of every channel.
+// Inputs and outputs hold channel after channel, each one value per position of the sequence.
+type ConvLayer struct {
+	// Kernel is the width of the windows, which move by Stride, 1 if left out. Convolutions may pad both ends of
+	// their input with Padding zeros.
+	Kernel  int
+	Stride  int `json:",omitempty"`
+	Padding int `json:",omitempty"`
+	// Channels is the number of filters of a convolution. Pooling layers keep the channels of their input.
+	Channels int `json:",omitempty"`
+	// Pool makes the layer a pooling layer, which has no weights.
+	Pool Pooling `json:",omitempty"`
+	// Activation of a convolution, tanh if left out.
+	Activation Activation `json:",omitempty"`
+}
+
+func (conv ConvLayer) stride() int {
+	if conv.Stride == 0 {
+		return 1
+	}
+	return conv.Stride
+}
+
+func (conv ConvLayer) activation() Activation {
+	if conv.Activation == "" {
+		return Tanh
+	}
+	return conv.Activation
+}
+
+// sequenceShape is the number of channels and the length of a sequence, the input or the output of a layer.
+type sequenceShape struct {
+	channels int
+	length   int
+}
+
+func (shape sequenceShape) size() int {
+	return shape.channels * shape.length
+}
+
+func (order *NNOrder) inputChannels() int {
+	if order.InputChannels == 0 {
+		return 1
+	}
+	return order.InputChannels
+}
+
+// sequenceShapes are the shapes of the input and of the outputs of all convolution layers. They assume the order
+// is valid.
+func (order *NNOrder) sequenceShapes() []sequenceShape {
+	shapes := []sequenceShape{{order.inputChannels(), order.D / order.inputChannels()}}
+	for _, conv := range order.Convolutions {
+		in := shapes[len(shapes)-1]
+		out := sequenceShape{conv.Channels, (in.length+2*conv.Padding-conv.Kernel)/conv.stride() + 1}
+		if conv.Pool != "" {
+			out.channels = in.channels
+		}
+		shapes = append(shapes, out)
+	}
+	return shapes
+}
+
+// denseInputs is the number of inputs of the first dense layer: D, or the outputs of the last convolution layer.
+func (order *NNOrder) denseInputs() int {
+	if len(order.Convolutions) == 0 {
+		return order.D
+	}
+	shapes := order.sequenceShapes()
+	return shapes[len(shapes)-1].size()
+}
+
+// convWeightsCount counts the weights of the convolutions, which precede the ones of the dense layers. The weights
+// of a convolution are ordered by filter, input channel and position in the window, and followed by one bias per
+// filter.
+func (order *NNOrder) convWeightsCount() int {
+	if len(order.Convolutions) == 0 {
+		return 0
+	}
+	count := 0
+	shapes := order.sequenceShapes()
+	for l, conv := range order.Convolutions {
+		if conv.Pool == "" {
+			count += conv.Channels*shapes[l].channels*conv.Kernel + order.biasCount(conv.Channels)
+		}
+	}
+	return count
+}
+
+func (order *NNOrder) validateConvolutions() InputErrors {
+	if order.InputChannels < 0 || (order.D > 0 && order.D%order.inputChannels() != 0) {
+		return InputErrors{inputErrorAt("Order.InputChannels", -1, -1, "the %d inputs can't be split into %d channels", order.D, order.InputChannels)}
+	}
+	if order.D <= 0 {
+		return nil
+	}
+
+	length := order.D / order.inputChannels()
+	for l, conv := range order.Convolutions {
+		var err *InputError
+		switch {
+		case conv.Kernel <= 0 || conv.Stride < 0 || conv.Padding < 0:
+			err = inputErrorAt("Order.Convolutions", l, -1, "kernel must be positive, stride and padding can't be negative")
+		case conv.Pool == "" && conv.Channels <= 0:
+			err = inputErrorAt("Order.Convolutions", l, -1, "a convolution needs a positive number of channels, got %d", conv.Channels)
+		case conv.Pool != "" && conv.Pool != MaxPooling && conv.Pool != AveragePooling:
+			err = inputErrorAt("Order.Convolutions", l, -1, "unknown pooling %q", conv.Pool)
+		case conv.Pool != "" && (conv.Channels != 0 || conv.Padding != 0 || conv.Activation != ""):
+			err = inputErrorAt("Order.Convolutions", l, -1, "pooling layers keep their channels and take no padding or activation")
+		case activationFunctions[conv.activation()].h == nil:
+			err = inputErrorAt("Order.Convolutions", l, -1, "unknown activation %q", conv.Activation)
+		case length+2*conv.Padding < conv.Kernel:
+			err = inputErrorAt("Order.Convolutions", l, -1, "kernel of %d is wider than the sequence of %d", conv.Kernel, length+2*conv.Padding)
+		}
+		if err != nil {
+			return InputErrors{err} // the shapes of the layers above depend on this one
+		}
+		length = (length+2*conv.Padding-conv.Kernel)/conv.stride() + 1
+	}
+	return nil
+}
+
+// convOffsets are where the weights of every convolution layer start.
+func (order *NNOrder) convOffsets(shapes []sequenceShape) []int {
+	offsets := make([]int, len(order.Convolutions))
+	offset := 0
+	for l, conv := range order.Convolutions {
+		offsets[l] = offset
+		if conv.Pool == "" {
+			offset += conv.Channels*shapes[l].channels*conv.Kernel + order.biasCount(conv.Channels)
+		}
+	}
+	return offsets
+}
+
+// conv_idx is the index of the weight of convolution layer at position k of the window over input channel c,
+// in filter o.
+func (nn *MultiLayerNN) conv_idx(layer int, o int, c int, k int) int {
+	return nn.convOffsets[layer] + (o*nn.shapes[layer].channels+c)*nn.structure.Convolutions[layer].Kernel + k
+}
+
+// convBias_idx is the index of the bias of filter o of convolution layer, when the network has biases.
+func (nn *MultiLayerNN) convBias_idx(layer int, o int) int {
+	conv := nn.structure.Convolutions[layer]
+	return nn.convOffsets[layer] + conv.Channels*nn.shapes[layer].channels*conv.Kernel + o
+}
+
+// convolve runs the convolution layers over x. z holds x and the outputs of every layer, a the activations of the
+// convolutions.
+func (nn *MultiLayerNN) convolve(x XVector) (a [][]float64, z [][]float64) {
+	if len(x) != nn.structure.D {
+		panic(fmt.Sprintf("invalid length of x: %d != %d", len(x), nn.structure.D))
+	}
+	shapes := nn.shapes
+	a = make([][]float64, len(shapes))
+	z = [][]float64{x}
+	for l, conv := range nn.structure.Convolutions {
+		in, out := shapes[l], shapes[l+1]
+		if conv.Pool != "" {
+			z = append(z, pool(conv, in, out, z[l]))
+			continue
+		}
+
+		a[l+1] = make([]float64, out.size())
+		for o := 0; o < out.channels; o++ {
+			for p := 0; p < out.length; p++ {
+				a_op := 0.0
+				if !nn.structure.NoBias {
+					a_op = nn.wts[nn.convBias_idx(l, o)]
+				}
+				for c := 0; c < in.channels; c++ {
+					window := nn.conv_idx(l, o, c, 0)
+					for k := 0; k < conv.Kernel; k++ {
+						if q := p*conv.stride() + k - conv.Padding; q >= 0 && q < in.length {
+							a_op += nn.wts[window+k] * z[l][c*in.length+q]
+						}
+					}
+				}
+				a[l+1][o*out.length+p] = a_op
+			}
+		}
+		z = append(z, mapOverVector(a[l+1], activationFunctions[conv.activation()].h))
+	}
+	return a, z
+}
+
+func pool(conv ConvLayer, in sequenceShape, out sequenceShape, z []float64) []float64 {
+	pooled := make([]float64, out.size())
+	for c := 0; c < out.channels; c++ {
+		for p := 0; p < out.length; p++ {
+			window := z[c*in.length+p*conv.stride() : c*in.length+p*conv.stride()+conv.Kernel]
+			if conv.Pool == MaxPooling {
+				pooled[c*out.length+p] = window[argmax(window)]
+			} else {
+				pooled[c*out.length+p] = mean(window)
+			}
+		}
+	}
+	return pooled
+}
+
+// backpropConvolutions takes delta, the derivative of the error by the outputs of the last convolution layer,
+// back through the layers, filling in the gradient by the weights of the convolutions.
+func (nn *MultiLayerNN) backpropConvolutions(a [][]float64, z [][]float64, delta []float64, gradient []float64) {
+	shapes := nn.shapes
+	for l := len(nn.structure.Convolutions) - 1; l >= 0; l-- {
+		conv, in, out := nn.structure.Convolutions[l], shapes[l], shapes[l+1]
+		delta_in := make([]float64, in.size())
+		if conv.Pool != "" {
+			for c := 0; c < out.channels; c++ {
+				for p := 0; p < out.length; p++ {
+					start := c*in.length + p*conv.stride()
+					if conv.Pool == MaxPooling {
+						delta_in[start+argmax(z[l][start:start+conv.Kernel])] += delta[c*out.length+p]
+						continue
+					}
+					for k := 0; k < conv.Kernel; k++ {
+						delta_in[start+k] += delta[c*out.length+p] / float64(conv.Kernel)
+					}
+				}
+			}
+			delta = delta_in
+			continue
+		}
+
+		h_prim := activationFunctions[conv.activation()].h_prim
+		for o := 0; o < out.channels; o++ {
+			for p := 0; p < out.length; p++ {
+				d := delta[o*out.length+p] * h_prim(a[l+1][o*out.length+p])
+				if !nn.structure.NoBias {
+					gradient[nn.convBias_idx(l, o)] += d
+				}
+				for c := 0; c < in.channels; c++ {
+					window := nn.conv_idx(l, o, c, 0)
+					for k := 0; k < conv.Kernel; k++ {
+						if q := p*conv.stride() + k - conv.Padding; q >= 0 && q < in.length {
+							gradient[window+k] += d * z[l][c*in.length+q]
+							delta_in[c*in.length+q] += nn.wts[window+k] * d
+						}
+					}
+				}
+			}
+		}
+		delta = delta_in
+	}
+}
+
+func argmax(values []float64) int {
+	best := 0
+	for i, v := range values {
+		if v > values[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+func mean(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
@@ -0,0 +1,71 @@
+package neuralnet
+
+import (
+	"fmt"
+	"strings"
+)
+
+// InputError reports an invalid caller-supplied value. Field names the offending request field, as it is spelled
+// in the JSON protocol. Row and Col locate the value within X, T or Wts, and are -1 where they don't apply.
+type InputError struct {
+	Field   string
+	Row     int
+	Col     int
+	Message string
+}
+
+func (e *InputError) Error() string {
+	switch {
+	case e.Row >= 0 && e.Col >= 0:
+		return fmt.Sprintf("%s[%d][%d]: %s", e.Field, e.Row, e.Col, e.Message)
+	case e.Row >= 0:
+		return fmt.Sprintf("%s[%d]: %s", e.Field, e.Row, e.Message)
+	default:
+		return fmt.Sprintf("%s: %s", e.Field, e.Message)
+	}
+}
+
+func inputErrorf(field string, format string, args ...interface{}) error {
+	return inputErrorAt(field, -1, -1, format, args...)
+}
+
+func inputErrorAt(field string, row int, col int, format string, args ...interface{}) *InputError {
+	return &InputError{field, row, col, fmt.Sprintf(format, args...)}
+}
+
+// InputErrors lists every problem found by a validation pass.
+type InputErrors []*InputError
+
+func (errs InputErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// orNil turns an empty list into a nil error.
+func (errs InputErrors) orNil() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Merge lists the problems of all errors given, skipping nils. It returns nil if there are none,
+// and the error itself if it isn't made of input errors.
+func Merge(errs ...error) error {
+	var all InputErrors
+	for _, err := range errs {
+		switch e := err.(type) {
+		case nil:
+		case *InputError:
+			all = append(all, e)
+		case InputErrors:
+			all = append(all, e...)
+		default:
+			return err
+		}
+	}
+	return all.orNil()
+}
@@ -0,0 +1,387 @@
+package neuralnet
+
+import "math"
+
+// LossParams are parameters of the error function that are fitted along with the network, like the dispersion of
+// the negative binomial distribution. They follow the network weights at the end of the weight vector.
+type LossParams struct {
+	Count         int
+	ErrorFunction func(y YVector, t YVector, params []float64) float64
+	// Derivative is the derivative of the error function by the predictions y.
+	Derivative func(y YVector, t YVector, params []float64) []float64
+	// Gradient is the derivative of the error function by the parameters.
+	Gradient func(y YVector, t YVector, params []float64) []float64
+}
+
+func (structure *NNStructure) lossParams(wts WeightVector) []float64 {
+	return wts[structure.weightsCount(structure.outputs()):]
+}
+
+// errorValue leaves out the targets that are missing, and is 0 if all of them are.
+func (structure *NNStructure) errorValue(y YVector, t YVector, wts WeightVector) float64 {
+	y, t, _ = structure.maskMissing(y, t)
+	if len(t) == 0 {
+		return 0
+	}
+	if structure.Params != nil {
+		return structure.Params.ErrorFunction(y, t, structure.lossParams(wts))
+	}
+	return structure.ErrorFunction(y, t)
+}
+
+// outputDelta is the derivative of the error function by the activations a of the output units.
+func (structure *NNStructure) outputDelta(a []float64, y YVector, t YVector, wts WeightVector) []float64 {
+	if structure.Canonical && structure.Params == nil {
+		r := residuals(y, t)
+		for k := range r {
+			if math.IsNaN(t[k]) {
+				r[k] = 0
+			}
+		}
+		return r
+	}
+
+	yObserved, tObserved, outputs := structure.maskMissing(y, t)
+	if len(tObserved) == 0 {
+		return make([]float64, len(a))
+	}
+	var dE_dy []float64
+	switch {
+	case structure.Params != nil:
+		dE_dy = structure.Params.Derivative(yObserved, tObserved, structure.lossParams(wts))
+	case structure.ErrorDerivative != nil:
+		dE_dy = structure.ErrorDerivative(yObserved, tObserved)
+	default:
+		dE_dy = numericalGradient(func(y []float64) float64 { return structure.ErrorFunction(y, tObserved) }, yObserved)
+	}
+	if outputs != nil {
+		dE_dy = scatter(dE_dy, outputs, len(y))
+	}
+
+	var jacobian [][]float64
+	if structure.SigmaPrim != nil {
+		jacobian = structure.SigmaPrim(a)
+	} else {
+		jacobian = numericalJacobian(structure.Sigma, a)
+	}
+
+	delta_k := make([]float64, len(a))
+	for k, row := range jacobian {
+		for j, dy_da := range row {
+			delta_k[j] += dE_dy[k] * dy_da
+		}
+	}
+	return delta_k
+}
+
+// maskMissing leaves out the missing targets of t, the ones that are NaN, and the outputs of y that predict them.
+// outputs are the indexes in y of the outputs left, or nil if no target is missing.
+func (structure *NNStructure) maskMissing(y YVector, t YVector) (YVector, YVector, []int) {
+	targets := []int{}
+	for k, v := range t {
+		if !math.IsNaN(v) {
+			targets = append(targets, k)
+		}
+	}
+	if len(targets) == len(t) {
+		return y, t, nil
+	}
+
+	outputs := targets
+	if structure.ObservedOutputs != nil {
+		outputs = structure.ObservedOutputs(targets)
+	}
+	yObserved, tObserved := make(YVector, len(outputs)), make(YVector, len(targets))
+	for i, k := range outputs {
+		yObserved[i] = y[k]
+	}
+	for i, k := range targets {
+		tObserved[i] = t[k]
+	}
+	return yObserved, tObserved, outputs
+}
+
+// scatter puts the values back at the indexes they were gathered from, leaving zeros elsewhere.
+func scatter(values []float64, indexes []int, n int) []float64 {
+	result := make([]float64, n)
+	for i, j := range indexes {
+		result[j] = values[i]
+	}
+	return result
+}
+
+func residuals(y YVector, t YVector) []float64 {
+	r := make([]float64, len(y))
+	for k := range r {
+		r[k] = y[k] - t[k]
+	}
+	return r
+}
+
+const numericalStep = 1e-6
+
+// numericalGradient approximates the gradient of f at x by central differences.
+func numericalGradient(f func([]float64) float64, x []float64) []float64 {
+	gradient := make([]float64, len(x))
+	shifted := append([]float64{}, x...)
+	for i := range x {
+		shifted[i] = x[i] + numericalStep
+		above := f(shifted)
+		shifted[i] = x[i] - numericalStep
+		below := f(shifted)
+		shifted[i] = x[i]
+		gradient[i] = (above - below) / (2 * numericalStep)
+	}
+	return gradient
+}
+
+func numericalJacobian(f func([]float64) YVector, x []float64) [][]float64 {
+	shifted := append([]float64{}, x...)
+	var jacobian [][]float64
+	for j := range x {
+		shifted[j] = x[j] + numericalStep
+		above := f(shifted)
+		shifted[j] = x[j] - numericalStep
+		below := f(shifted)
+		shifted[j] = x[j]
+		if jacobian == nil {
+			jacobian = make([][]float64, len(above))
+			for k := range jacobian {
+				jacobian[k] = make([]float64, len(x))
+			}
+		}
+		for k := range above {
+			jacobian[k][j] = (above[k] - below[k]) / (2 * numericalStep)
+		}
+	}
+	return jacobian
+}
+
+// paramsGradient adds the gradient by the parameters of the error function, if there are any.
+func (structure *NNStructure) paramsGradient(gradient []float64, y YVector, t YVector, wts WeightVector) {
+	if structure.Params == nil {
+		return
+	}
+	if y, t, _ = structure.maskMissing(y, t); len(t) > 0 {
+		params := structure.lossParams(gradient)
+		for i, g := range structure.Params.Gradient(y, t, structure.lossParams(wts)) {
+			params[i] += g
+		}
+	}
+}
+
+// ResponseParams tune the error functions of some response types.
+type ResponseParams struct {
+	// Quantile is the quantile predicted by Quantile networks, between 0 and 1.
+	Quantile float64
+	// HuberDelta is where the loss of Huber networks turns from quadratic to linear.
+	HuberDelta float64
+	// Components is the number of normal distributions mixed by MixtureDensity networks.
+	Components int
+}
+
+var DefaultResponseParams = ResponseParams{Quantile: 0.5, HuberDelta: 1, Components: 3}
+
+// Resolve fills in the defaults of the parameters left at zero and reports invalid ones.
+func (params ResponseParams) Resolve() (ResponseParams, error) {
+	var errs InputErrors
+	if params.Quantile == 0 {
+		params.Quantile = DefaultResponseParams.Quantile
+	} else if !(params.Quantile > 0 && params.Quantile < 1) {
+		errs = append(errs, inputErrorAt("ResponseParams.Quantile", -1, -1, "quantile must be between 0 and 1, got %g", params.Quantile))
+	}
+	if params.HuberDelta == 0 {
+		params.HuberDelta = DefaultResponseParams.HuberDelta
+	} else if !(params.HuberDelta > 0) {
+		errs = append(errs, inputErrorAt("ResponseParams.HuberDelta", -1, -1, "delta must be positive, got %g", params.HuberDelta))
+	}
+	if params.Components == 0 {
+		params.Components = DefaultResponseParams.Components
+	} else if params.Components < 0 {
+		errs = append(errs, inputErrorAt("ResponseParams.Components", -1, -1, "number of components must be positive, got %d", params.Components))
+	}
+	return params, errs.orNil()
+}
+
+func huberLoss(delta float64) (func(y YVector, t YVector) float64, func(y YVector, t YVector) []float64) {
+	loss := func(y YVector, t YVector) float64 {
+		result := 0.0
+		for i := range t {
+			if r := math.Abs(y[i] - t[i]); r <= delta {
+				result += r * r / 2
+			} else {
+				result += delta * (r - delta/2)
+			}
+		}
+		return result
+	}
+	derivative := func(y YVector, t YVector) []float64 {
+		delta_k := make([]float64, len(y))
+		for k := range delta_k {
+			delta_k[k] = math.Max(-delta, math.Min(delta, y[k]-t[k]))
+		}
+		return delta_k
+	}
+	return loss, derivative
+}
+
+func absoluteLoss(y YVector, t YVector) float64 {
+	result := 0.0
+	for i := range t {
+		result += math.Abs(y[i] - t[i])
+	}
+	return result
+}
+
+func absoluteLossDerivative(y YVector, t YVector) []float64 {
+	delta_k := make([]float64, len(y))
+	for k := range delta_k {
+		delta_k[k] = sign(y[k] - t[k])
+	}
+	return delta_k
+}
+
+// pinballLoss weighs targets above the prediction by quantile and the ones below by 1 - quantile.
+func pinballLoss(quantile float64) (func(y YVector, t YVector) float64, func(y YVector, t YVector) []float64) {
+	loss := func(y YVector, t YVector) float64 {
+		result := 0.0
+		for i := range t {
+			if r := t[i] - y[i]; r >= 0 {
+				result += quantile * r
+			} else {
+				result -= (1 - quantile) * r
+			}
+		}
+		return result
+	}
+	derivative := func(y YVector, t YVector) []float64 {
+		delta_k := make([]float64, len(y))
+		for k := range delta_k {
+			switch {
+			case t[k] > y[k]:
+				delta_k[k] = -quantile
+			case t[k] < y[k]:
+				delta_k[k] = 1 - quantile
+			}
+		}
+		return delta_k
+	}
+	return loss, derivative
+}
+
+func sign(x float64) float64 {
+	switch {
+	case x > 0:
+		return 1
+	case x < 0:
+		return -1
+	default:
+		return 0
+	}
+}
+
+// poissonDeviance is half the deviance, so that it pairs canonically with exp outputs.
+func poissonDeviance(y YVector, t YVector) float64 {
+	result := 0.0
+	for i := range t {
+		result += y[i] - t[i]
+		if t[i] > 0 {
+			result += t[i] * math.Log(t[i]/y[i])
+		}
+	}
+	return result
+}
+
+func poissonDevianceDerivative(y YVector, t YVector) []float64 {
+	dE_dy := make([]float64, len(y))
+	for k := range dE_dy {
+		dE_dy[k] = 1 - t[k]/y[k]
+	}
+	return dE_dy
+}
+
+// gaussianNLL is the negative log-likelihood of t under normal distributions with means y[:K] and log-variances y[K:].
+func gaussianNLL(y YVector, t YVector) float64 {
+	result := 0.0
+	for k := range t {
+		r, logVariance := t[k]-y[k], y[len(t)+k]
+		result += (math.Log(2*math.Pi) + logVariance + r*r*math.Exp(-logVariance)) / 2
+	}
+	return result
+}
+
+func gaussianNLLDerivative(y YVector, t YVector) []float64 {
+	dE_dy := make([]float64, len(y))
+	for k := range t {
+		r, precision := t[k]-y[k], math.Exp(-y[len(t)+k])
+		dE_dy[k] = -r * precision
+		dE_dy[len(t)+k] = (1 - r*r*precision) / 2
+	}
+	return dE_dy
+}
+
+// gaussianOutputs are the means and the log-variances of the targets.
+func gaussianOutputs(K int) func(targets []int) []int {
+	return func(targets []int) []int {
+		outputs := append([]int{}, targets...)
+		for _, k := range targets {
+			outputs = append(outputs, K+k)
+		}
+		return outputs
+	}
+}
+
+func gaussianMoments(y YVector) (mean YVector, stddev YVector) {
+	K := len(y) / 2
+	stddev = make(YVector, K)
+	for k := range stddev {
+		stddev[k] = math.Exp(y[K+k] / 2)
+	}
+	return y[:K:K], stddev
+}
+
+// negativeBinomial is the NB2 distribution with means y and variances y + y^2/theta. The only parameter is
+// log(theta), which keeps theta positive while fitting.
+var negativeBinomial = &LossParams{
+	Count: 1,
+	ErrorFunction: func(y YVector, t YVector, params []float64) float64 {
+		theta := math.Exp(params[0])
+		result := 0.0
+		for i := range t {
+			result -= lgamma(t[i]+theta) - lgamma(theta) - lgamma(t[i]+1) +
+				theta*math.Log(theta/(theta+y[i])) + t[i]*math.Log(y[i]/(theta+y[i]))
+		}
+		return result
+	},
+	Derivative: func(y YVector, t YVector, params []float64) []float64 {
+		theta := math.Exp(params[0])
+		dE_dy := make([]float64, len(y))
+		for k := range dE_dy {
+			dE_dy[k] = theta * (y[k] - t[k]) / (y[k] * (theta + y[k]))
+		}
+		return dE_dy
+	},
+	Gradient: func(y YVector, t YVector, params []float64) []float64 {
+		theta := math.Exp(params[0])
+		dTheta := 0.0
+		for i := range t {
+			dTheta -= digamma(t[i]+theta) - digamma(theta) + math.Log(theta/(theta+y[i])) + (y[i]-t[i])/(theta+y[i])
+		}
+		return []float64{dTheta * theta}
+	},
+}
+
+func lgamma(x float64) float64 {
+	v, _ := math.Lgamma(x)
+	return v
+}
+
+// digamma shifts x above 6 by the recurrence psi(x) = psi(x+1) - 1/x, then sums the asymptotic series.
+func digamma(x float64) float64 {
+	result := 0.0
+	for ; x < 6; x++ {
+		result -= 1 / x
+	}
+	f := 1 / (x * x)
+	return result + math.Log(x) - 0.5/x - f*(1.0/12-f*(1.0/120-f*(1.0/252-f*(1.0/240-f/132))))
+}
@@ -0,0 +1,60 @@
+package neuralnet
+
+// WeightState tells whether fitting may change a weight.
+type WeightState string
+
+const (
+	Trainable WeightState = "trainable"
+	// Frozen weights keep the values they are given.
+	Frozen WeightState = "frozen"
+	// Absent weights are pruned connections, which are always 0.
+	Absent WeightState = "absent"
+)
+
+// WeightMask holds the state of every packed weight, the parameters of the error function included.
+// A nil mask trains all of them.
+type WeightMask []WeightState
+
+func (mask WeightMask) validate(count int) InputErrors {
+	if mask == nil {
+		return nil
+	}
+	var errs InputErrors
+	if len(mask) != count {
+		errs = append(errs, inputErrorAt("Mask", -1, -1, "expected a state for each of the %d weights, got %d", count, len(mask)))
+	}
+	for i, state := range mask {
+		switch state {
+		case Trainable, Frozen, Absent:
+		default:
+			errs = append(errs, inputErrorAt("Mask", i, -1, "unknown weight state %q", state))
+		}
+	}
+	return errs
+}
+
+// apply zeroes the absent weights. It returns wts itself when there are none.
+func (mask WeightMask) apply(wts WeightVector) WeightVector {
+	var masked WeightVector
+	for i, state := range mask {
+		if state == Absent && wts[i] != 0 {
+			if masked == nil {
+				masked = append(WeightVector{}, wts...)
+			}
+			masked[i] = 0
+		}
+	}
+	if masked == nil {
+		return wts
+	}
+	return masked
+}
+
+// fix zeroes the gradient by the weights that aren't trainable, so that no fit moves them.
+func (mask WeightMask) fix(gradient []float64) {
+	for i, state := range mask {
+		if state != Trainable {
+			gradient[i] = 0
+		}
+	}
+}
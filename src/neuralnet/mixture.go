@@ -0,0 +1,223 @@
+package neuralnet
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Mixture is a mixture of isotropic normal distributions, predicted by MixtureDensity networks.
+type Mixture struct {
+	Weights   []float64
+	Means     [][]float64
+	Variances []float64
+}
+
+// mixtureOf reads the outputs of a MixtureDensity network: the mixing coefficients, the means of every component
+// one after another, then the variances.
+func mixtureOf(y YVector, components int) *Mixture {
+	K := (len(y) - 2*components) / components
+	mixture := &Mixture{y[:components:components], make([][]float64, components), y[components+components*K:]}
+	for c := range mixture.Means {
+		start := components + c*K
+		mixture.Means[c] = y[start : start+K : start+K]
+	}
+	return mixture
+}
+
+// mixtureOutputs are all the mixing coefficients and variances, and the means of the targets in every component.
+// Leaving out targets marginalizes them, as the components are isotropic.
+func mixtureOutputs(components int, K int) func(targets []int) []int {
+	return func(targets []int) []int {
+		var outputs []int
+		for c := 0; c < components; c++ {
+			outputs = append(outputs, c)
+		}
+		for c := 0; c < components; c++ {
+			for _, k := range targets {
+				outputs = append(outputs, components+c*K+k)
+			}
+		}
+		for c := 0; c < components; c++ {
+			outputs = append(outputs, components+components*K+c)
+		}
+		return outputs
+	}
+}
+
+// mixtureSigma applies softmax to the activations of the mixing coefficients and exp to those of the variances.
+func mixtureSigma(components int) func([]float64) YVector {
+	return func(a []float64) YVector {
+		y := make(YVector, len(a))
+		copy(y, softmax(a[:components]))
+		varianceStart := len(a) - components
+		copy(y[components:varianceStart], a[components:varianceStart])
+		for i := varianceStart; i < len(a); i++ {
+			y[i] = math.Exp(a[i])
+		}
+		return y
+	}
+}
+
+func mixtureSigmaPrim(components int) func([]float64) [][]float64 {
+	return func(a []float64) [][]float64 {
+		jacobian := make([][]float64, len(a))
+		for k := range jacobian {
+			jacobian[k] = make([]float64, len(a))
+		}
+		for k, row := range softmaxPrim(a[:components]) {
+			copy(jacobian[k], row)
+		}
+		varianceStart := len(a) - components
+		for k := components; k < varianceStart; k++ {
+			jacobian[k][k] = 1
+		}
+		for k := varianceStart; k < len(a); k++ {
+			jacobian[k][k] = math.Exp(a[k])
+		}
+		return jacobian
+	}
+}
+
+// logDensities are the logs of the weighted densities of the components at t.
+func (mixture *Mixture) logDensities(t []float64) []float64 {
+	K := float64(len(t))
+	logs := make([]float64, len(mixture.Weights))
+	for c, mean := range mixture.Means {
+		logs[c] = math.Log(mixture.Weights[c]) - K/2*math.Log(2*math.Pi*mixture.Variances[c]) -
+			ssqdiff(t, mean)/(2*mixture.Variances[c])
+	}
+	return logs
+}
+
+// responsibilities are the posterior probabilities of the components given t, and the log of the density at t.
+func (mixture *Mixture) responsibilities(t []float64) ([]float64, float64) {
+	logs := mixture.logDensities(t)
+	max := math.Inf(-1)
+	for _, l := range logs {
+		max = math.Max(max, l)
+	}
+	sum := 0.0
+	for c, l := range logs {
+		logs[c] = math.Exp(l - max)
+		sum += logs[c]
+	}
+	for c := range logs {
+		logs[c] /= sum
+	}
+	return logs, max + math.Log(sum)
+}
+
+func mixtureNLL(components int) func(y YVector, t YVector) float64 {
+	return func(y YVector, t YVector) float64 {
+		_, logDensity := mixtureOf(y, components).responsibilities(t)
+		return -logDensity
+	}
+}
+
+func mixtureNLLDerivative(components int) func(y YVector, t YVector) []float64 {
+	return func(y YVector, t YVector) []float64 {
+		mixture := mixtureOf(y, components)
+		gamma, _ := mixture.responsibilities(t)
+		K := len(t)
+		dE_dy := make([]float64, len(y))
+		for c, mean := range mixture.Means {
+			variance := mixture.Variances[c]
+			dE_dy[c] = -gamma[c] / mixture.Weights[c]
+			for k := range mean {
+				dE_dy[components+c*K+k] = -gamma[c] * (t[k] - mean[k]) / variance
+			}
+			dE_dy[len(y)-components+c] = -gamma[c] * (ssqdiff(t, mean)/(2*variance*variance) - float64(K)/(2*variance))
+		}
+		return dE_dy
+	}
+}
+
+func mixtureMoments(components int) func(y YVector) (YVector, YVector) {
+	return func(y YVector) (YVector, YVector) {
+		mixture := mixtureOf(y, components)
+		return mixture.Mean(), mixture.StdDev()
+	}
+}
+
+func (mixture *Mixture) Mean() YVector {
+	mean := make(YVector, len(mixture.Means[0]))
+	for c, m := range mixture.Means {
+		for k := range mean {
+			mean[k] += mixture.Weights[c] * m[k]
+		}
+	}
+	return mean
+}
+
+// StdDev is the standard deviation of every target, from the law of total variance.
+func (mixture *Mixture) StdDev() YVector {
+	mean := mixture.Mean()
+	stddev := make(YVector, len(mean))
+	for k := range stddev {
+		variance := 0.0
+		for c, m := range mixture.Means {
+			variance += mixture.Weights[c] * (mixture.Variances[c] + (m[k]-mean[k])*(m[k]-mean[k]))
+		}
+		stddev[k] = math.Sqrt(variance)
+	}
+	return stddev
+}
+
+const modeIterations = 100
+
+// Mode finds the most probable point of the mixture by fixed-point iteration from the mean of every component.
+func (mixture *Mixture) Mode() YVector {
+	var best YVector
+	bestDensity := math.Inf(-1)
+	for _, start := range mixture.Means {
+		x := append(YVector{}, start...)
+		for i := 0; i < modeIterations; i++ {
+			gamma, _ := mixture.responsibilities(x)
+			next, norm := make(YVector, len(x)), 0.0
+			for c, mean := range mixture.Means {
+				w := gamma[c] / mixture.Variances[c]
+				for k := range next {
+					next[k] += w * mean[k]
+				}
+				norm += w
+			}
+			for k := range next {
+				next[k] /= norm
+			}
+			converged := ssqdiff(next, x) < 1e-24
+			x = next
+			if converged {
+				break
+			}
+		}
+		if _, density := mixture.responsibilities(x); density > bestDensity {
+			best, bestDensity = x, density
+		}
+	}
+	return best
+}
+
+// Sample draws a point from the mixture.
+func (mixture *Mixture) Sample(rnd *rand.Rand) YVector {
+	u, c := rnd.Float64(), 0
+	for ; c < len(mixture.Weights)-1; c++ {
+		if u < mixture.Weights[c] {
+			break
+		}
+		u -= mixture.Weights[c]
+	}
+	stddev := math.Sqrt(mixture.Variances[c])
+	x := make(YVector, len(mixture.Means[c]))
+	for k := range x {
+		x[k] = mixture.Means[c][k] + stddev*rnd.NormFloat64()
+	}
+	return x
+}
+
+// MixtureOf returns the mixture a MixtureDensity network predicts with the outputs y, or nil for other networks.
+func (structure *NNStructure) MixtureOf(y YVector) *Mixture {
+	if structure.ResponseType != MixtureDensity {
+		return nil
+	}
+	return mixtureOf(y, structure.ResponseParams.Components)
+}
@@ -1,44 +1,70 @@
 package neuralnet
 
-import "fmt"
+import (
+	"fmt"
+	"gonum.org/v1/gonum/floats"
+)
 
 type MultiLayerNN struct {
 	structure *NNStructure
 	wts       WeightVector
 	L         []int
+	// offsets[l] is where the weights into layer l+1 start, after the ones of the convolutions and of the layers
+	// below; the last one is where the skips start.
+	offsets []int
+	// skipOffsets[s] is where the weights of skip s start.
+	skipOffsets []int
+	// shapes are the ones of the input and the outputs of the convolution layers, whose weights start at
+	// convOffsets.
+	shapes      []sequenceShape
+	convOffsets []int
+	// recurrentOffset is where the weights of the first hidden layer back into itself start, if it's recurrent.
+	recurrentOffset int
+	// count is the number of packed weights.
+	count int
+}
+
+func newMultiLayerNN(structure *NNStructure, wts WeightVector) *MultiLayerNN {
+	L := networkLayers(structure)
+	offsets := make([]int, len(L))
+	offsets[0] = structure.convWeightsCount()
+	for l := 1; l < len(L); l++ {
+		offsets[l] = offsets[l-1] + L[l-1]*L[l] + structure.biasCount(L[l])
+	}
+	skipOffsets := make([]int, len(structure.Skips))
+	offset := offsets[len(L)-1]
+	for s, skip := range structure.Skips {
+		skipOffsets[s] = offset
+		offset += L[skip.From] * L[skip.To]
+	}
+	shapes := structure.sequenceShapes()
+	return &MultiLayerNN{structure, wts, L, offsets, skipOffsets, shapes, structure.convOffsets(shapes), offset, structure.packedWeightsCount()}
 }
 
 func (nn *MultiLayerNN) PackedWts() []float64 {
 	return nn.wts
 }
 
+// wt_idx is the index of the weight from unit i in layer to unit j in layer+1.
 func (nn *MultiLayerNN) wt_idx(layer int, j int, i int) int {
-	if layer >= len(nn.L)-1 {
-		panic(fmt.Sprintf("layer index too high: %d >= %d", layer, len(nn.L)-1))
-	}
-	if i >= nn.L[layer] {
-		panic(fmt.Sprintf("index out of bounds for layer %d: %d >= %d", layer, i, nn.L[layer]))
-	}
-	if j >= nn.L[layer+1] {
-		panic(fmt.Sprintf("index out of bounds for layer %d: %d >= %d", layer+1, j, nn.L[layer+1]))
-	}
+	return nn.offsets[layer] + i + j*nn.L[layer]
+}
 
-	offset := 0
-	for l := 0; l < layer; l++ {
-		offset += nn.L[l] * nn.L[l+1]
-	}
-	result := offset + i + j*nn.L[layer]
-	if result >= nn.structure.ExpectedPackedWeightsCount() {
-		panic(fmt.Sprintf("can't access index %d >= %d", result, nn.structure.ExpectedPackedWeightsCount()))
-	}
-	return result
+// bias_idx is the index of the bias of unit j in layer+1, when the network has biases.
+func (nn *MultiLayerNN) bias_idx(layer int, j int) int {
+	return nn.offsets[layer] + nn.L[layer]*nn.L[layer+1] + j
+}
+
+// skip_idx is the index of the weight of skip s from unit i of its From layer to unit j of its To layer.
+func (nn *MultiLayerNN) skip_idx(s int, j int, i int) int {
+	return nn.skipOffsets[s] + i + j*nn.L[nn.structure.Skips[s].From]
 }
 
 func (nn *MultiLayerNN) Predict(x XVector) YVector {
 	_, z := nn.fwdPropHidden(x)
 
-	a_k := nn.a_j(len(nn.L)-2, z[len(nn.L)-2])
-	y_k := mapOverVector(a_k, nn.structure.Sigma)
+	a_k := nn.a_k(z)
+	y_k := nn.structure.Sigma(a_k)
 
 	return y_k
 }
@@ -46,7 +72,7 @@ func (nn *MultiLayerNN) Predict(x XVector) YVector {
 func (nn *MultiLayerNN) z_j(l int, layer_next_a []float64) XVector {
 	layer_z := make([]float64, nn.L[l+1])
 	for j := range layer_next_a {
-		layer_z[j] = nn.structure.H(layer_next_a[j])
+		layer_z[j] = nn.structure.H[l](layer_next_a[j])
 	}
 	return layer_z
 }
@@ -54,6 +80,9 @@ func (nn *MultiLayerNN) z_j(l int, layer_next_a []float64) XVector {
 func (nn *MultiLayerNN) a_j(l int, layer_z XVector) []float64 {
 	layer_next_a := make([]float64, nn.L[l+1])
 	for j := range layer_next_a {
+		if !nn.structure.NoBias {
+			layer_next_a[j] = nn.wts[nn.bias_idx(l, j)]
+		}
 		for i := range layer_z {
 			layer_next_a[j] += nn.wts[nn.wt_idx(l, j, i)] * layer_z[i]
 		}
@@ -61,71 +90,137 @@ func (nn *MultiLayerNN) a_j(l int, layer_z XVector) []float64 {
 	return layer_next_a
 }
 
+// a_k are the activations of the output units, from the outputs z of the input and hidden layers.
+func (nn *MultiLayerNN) a_k(z [][]float64) []float64 {
+	a_k := nn.a_j(len(nn.L)-2, z[len(nn.L)-2])
+	nn.addSkips(len(nn.L)-1, z, a_k)
+	return a_k
+}
+
+// addSkips adds what the skips into layer to contribute to its activations a.
+func (nn *MultiLayerNN) addSkips(to int, z [][]float64, a []float64) {
+	for s, skip := range nn.structure.Skips {
+		if skip.To != to {
+			continue
+		}
+		for j := range a {
+			for i, zi := range z[skip.From] {
+				a[j] += nn.wts[nn.skip_idx(s, j, i)] * zi
+			}
+		}
+	}
+}
+
 func (nn *MultiLayerNN) ErfValue(x XVector, t YVector) float64 {
 	if len(t) != nn.structure.K {
 		panic(fmt.Sprintf("invalid length of t: %d != %d", len(t), nn.structure.K))
 	}
 
-	return nn.structure.ErrorFunction(nn.Predict(x), t)
+	return nn.structure.errorValue(nn.Predict(x), t, nn.wts)
 }
 
 func (nn *MultiLayerNN) Gradient(x XVector, t YVector) WeightVector {
-	gradient := make([]float64, nn.structure.ExpectedPackedWeightsCount())
+	gradient := make([]float64, nn.count)
 
-	a, z := nn.fwdPropHidden(x)
-	a_k := nn.a_j(len(nn.L)-2, z[len(nn.L)-2])
-	y := mapOverVector(a_k, nn.structure.Sigma)
-	delta_k := make([]float64, nn.structure.K)
-	for k := range delta_k {
-		delta_k[k] = y[k] - t[k] // Assuming canonical link function is used...
+	convA, convZ := nn.convolve(x)
+	a, z := nn.fwdPropDense(convZ[len(convZ)-1], nil)
+	a_k := nn.a_k(z)
+	y := nn.structure.Sigma(a_k)
+	delta_k := nn.structure.outputDelta(a_k, y, t, nn.wts)
+
+	delta_j := nn.backprop(gradient, a, z, delta_k, nil)
+	if len(nn.structure.Convolutions) != 0 {
+		nn.backpropConvolutions(convA, convZ, nn.backpropLayer(0, delta_j), gradient)
 	}
+	nn.structure.paramsGradient(gradient, y, t, nn.wts)
+	nn.structure.Ties.sum(gradient)
+	nn.structure.Mask.fix(gradient)
+	return gradient
+}
 
+// backprop adds the gradient by the weights of the dense layers and the skips, from the deltas of the output
+// units, and returns the deltas of all layers. carry, if not nil, is added to the derivative of the error by the
+// outputs of the first hidden layer.
+func (nn *MultiLayerNN) backprop(gradient []float64, a [][]float64, z [][]float64, delta_k []float64, carry []float64) [][]float64 {
 	delta_j := make([][]float64, len(nn.L))
 	delta_j[len(nn.L)-1] = delta_k
-	for l := len(nn.L) - 2; l >= 1; l-- { // backprop
-		delta_j[l] = make([]float64, nn.L[l])
+	for l := len(nn.L) - 2; l >= 1; l-- {
+		delta_j[l] = nn.backpropLayer(l, delta_j)
+		if l == 1 && carry != nil {
+			floats.Add(delta_j[l], carry)
+		}
 		for j := range delta_j[l] {
-			for k := range delta_j[l+1] {
-				delta_j[l][j] += nn.wts[nn.wt_idx(l, k, j)] * delta_j[l+1][k]
-			}
-			delta_j[l][j] *= nn.structure.H_prim(a[l][j])
+			delta_j[l][j] *= nn.structure.H_prim[l-1](a[l][j])
 		}
 	}
 
 	for l := 0; l < len(nn.L)-1; l++ {
 		for j, dj := range delta_j[l+1] {
 			for i, zi := range z[l] {
-				gradient[nn.wt_idx(l, j, i)] = dj * zi
+				gradient[nn.wt_idx(l, j, i)] += dj * zi
+			}
+			if !nn.structure.NoBias {
+				gradient[nn.bias_idx(l, j)] += dj
 			}
 		}
 	}
-	return gradient
+	for s, skip := range nn.structure.Skips {
+		for j, dj := range delta_j[skip.To] {
+			for i, zi := range z[skip.From] {
+				gradient[nn.skip_idx(s, j, i)] += dj * zi
+			}
+		}
+	}
+	return delta_j
+}
+
+// backpropLayer is the derivative of the error by the outputs of layer l, from the deltas of the layers above.
+func (nn *MultiLayerNN) backpropLayer(l int, delta_j [][]float64) []float64 {
+	delta := make([]float64, nn.L[l])
+	for j := range delta {
+		for k := range delta_j[l+1] {
+			delta[j] += nn.wts[nn.wt_idx(l, k, j)] * delta_j[l+1][k]
+		}
+		for s, skip := range nn.structure.Skips {
+			if skip.From == l {
+				for k, dk := range delta_j[skip.To] {
+					delta[j] += nn.wts[nn.skip_idx(s, k, j)] * dk
+				}
+			}
+		}
+	}
+	return delta
 }
 
 func (nn *MultiLayerNN) fwdPropHidden(x XVector) ([][]float64, [][]float64) {
+	_, convZ := nn.convolve(x)
+	return nn.fwdPropDense(convZ[len(convZ)-1], nil)
+}
+
+// fwdPropDense runs the hidden layers on the inputs of the dense layers. previous are the outputs of the first
+// hidden layer at the previous step of a sequence, fed back by recurrent networks, or nil.
+func (nn *MultiLayerNN) fwdPropDense(x []float64, previous []float64) ([][]float64, [][]float64) {
 	a := make([][]float64, len(nn.L)-1)
 	z := make([][]float64, len(nn.L)-1)
 	z[0] = x
 	for l := 0; l < len(nn.L)-2; l++ { // hidden layers
 		a[l+1] = nn.a_j(l, z[l])
+		nn.addSkips(l+1, z, a[l+1])
+		if l == 0 && previous != nil {
+			nn.addRecurrent(previous, a[1])
+		}
 		z[l+1] = nn.z_j(l, a[l+1])
 	}
 	return a, z
 }
 
+// Hidden lists the outputs of the convolution layers, then the ones of the hidden layers.
 func (nn *MultiLayerNN) Hidden(x XVector) []float64 {
-	_, z := nn.fwdPropHidden(x)
-	hiddenCnt := 0
-	for _, l := range nn.structure.M {
-		hiddenCnt += l
-	}
-	z_flat := make([]float64, hiddenCnt)
-	i := 0
-	for _, zv := range z[1:] {
-		for _, v := range zv {
-			z_flat[i] = v
-			i++
-		}
+	_, convZ := nn.convolve(x)
+	_, z := nn.fwdPropDense(convZ[len(convZ)-1], nil)
+	var z_flat []float64
+	for _, zv := range append(convZ[1:], z[1:]...) {
+		z_flat = append(z_flat, zv...)
 	}
 	return z_flat
 }
@@ -15,13 +15,25 @@ type NeuralNetwork interface {
 }
 
 func ErfSampleValue(nn NeuralNetwork, x XSample, t YSample) float64 {
+	return WeightedErfSampleValue(nn, x, t, nil)
+}
+
+// WeightedErfSampleValue sums the error function over the rows, each multiplied by its weight. Nil weights are all 1.
+func WeightedErfSampleValue(nn NeuralNetwork, x XSample, t YSample, weights []float64) float64 {
 	value := 0.0
 	for i := range x {
-		value += nn.ErfValue(x[i], t[i])
+		value += sampleWeight(weights, i) * nn.ErfValue(x[i], t[i])
 	}
 	return value
 }
 
+func sampleWeight(weights []float64, i int) float64 {
+	if weights == nil {
+		return 1
+	}
+	return weights[i]
+}
+
 func PredictSample(nn NeuralNetwork, sample_x XSample) YSample {
 	result := make(YSample, len(sample_x))
 	for i, xv := range sample_x {
@@ -30,10 +42,32 @@ func PredictSample(nn NeuralNetwork, sample_x XSample) YSample {
 	return result
 }
 
+// MomentsSample predicts the means of the targets and, if the structure predicts them, their standard deviations.
+func MomentsSample(structure *NNStructure, nn NeuralNetwork, sample_x XSample) (means YSample, stddevs YSample) {
+	means = make(YSample, len(sample_x))
+	for i, xv := range sample_x {
+		y := nn.Predict(xv)
+		if structure.MomentsOf == nil {
+			means[i] = y
+			continue
+		}
+		if stddevs == nil {
+			stddevs = make(YSample, len(sample_x))
+		}
+		means[i], stddevs[i] = structure.MomentsOf(y)
+	}
+	return means, stddevs
+}
+
 func GradientSample(nn NeuralNetwork, sample_x XSample, sample_t YSample) []float64 {
+	return WeightedGradientSample(nn, sample_x, sample_t, nil)
+}
+
+// WeightedGradientSample is the gradient of WeightedErfSampleValue.
+func WeightedGradientSample(nn NeuralNetwork, sample_x XSample, sample_t YSample, weights []float64) []float64 {
 	gradient := make([]float64, len(nn.PackedWts()))
 	for n := range sample_x {
-		floats.Add(gradient, nn.Gradient(sample_x[n], sample_t[n]))
+		floats.AddScaled(gradient, sampleWeight(weights, n), nn.Gradient(sample_x[n], sample_t[n]))
 	}
 	return gradient
 }
@@ -1,46 +1,49 @@
 package neuralnet
 
 import (
+	"context"
 	"fmt"
 	"gonum.org/v1/gonum/floats"
+	"math"
 	"math/rand"
 	"testing"
+	"time"
 )
 
 func TestSingleLayerNetwork(t *testing.T) {
-	structure := NNOrder{2, []int{4}, 3}.OfResponseType(Regression)
-	w0 := ArrayOfSize(structure.ExpectedPackedWeightsCount(), 1.0)
+	structure := mustStructure(t, NNOrder{D: 2, M: []int{4}, K: 3, NoBias: true}, Regression)
+	w0 := ArrayOfSize(mustWeightsCount(t, structure), 1.0)
 
 	sample_x := XSample{{1, 1}}
 	sample_t := YSample{{1, 2, 3}}
 
-	nn := structure.SNForWeights(w0)
-	best_nn := FitByCG(structure.SNForWeights, sample_x, sample_t, w0, false, 1e-12, 100)
+	nn := mustNetwork(t, structure.SNForWeights, w0)
+	best_nn := mustFit(t, structure.SNForWeights, sample_x, sample_t, w0, 100)
 
 	expectTemplateNetwork(t, nn, best_nn, sample_x, sample_t)
 }
 
 func TestMLNWithSingleLayer(t *testing.T) {
-	structure := NNOrder{2, []int{4}, 3}.OfResponseType(Regression)
-	w0 := ArrayOfSize(structure.ExpectedPackedWeightsCount(), 1.0)
+	structure := mustStructure(t, NNOrder{D: 2, M: []int{4}, K: 3, NoBias: true}, Regression)
+	w0 := ArrayOfSize(mustWeightsCount(t, structure), 1.0)
 
 	sample_x := XSample{{1, 1}}
 	sample_t := YSample{{1, 2, 3}}
 
-	nn := structure.ForWeights(w0)
-	best_nn := FitByCG(structure.ForWeights, sample_x, sample_t, w0, false, 1e-12, 100)
+	nn := mustNetwork(t, structure.ForWeights, w0)
+	best_nn := mustFit(t, structure.ForWeights, sample_x, sample_t, w0, 100)
 
 	expectTemplateNetwork(t, nn, best_nn, sample_x, sample_t)
 }
 
 func TestMultiLayerNetwork(t *testing.T) {
-	structure := NNOrder{2, []int{3, 2}, 3}.OfResponseType(Regression)
-	w0 := ArrayOfSize(structure.ExpectedPackedWeightsCount(), 1.0)
+	structure := mustStructure(t, NNOrder{D: 2, M: []int{3, 2}, K: 3, NoBias: true}, Regression)
+	w0 := ArrayOfSize(mustWeightsCount(t, structure), 1.0)
 
 	sample_x := XSample{{1, 1}, {1, 2}, {2, 1}}
 	sample_t := YSample{{1, 2, 3}, {3, 2, 3}, {3, 2, 1}}
 
-	nn := structure.ForWeights(w0)
+	nn := mustNetwork(t, structure.ForWeights, w0)
 
 	ExpectNN(
 		t, sample_x, sample_t, nn,
@@ -50,7 +53,7 @@ func TestMultiLayerNetwork(t *testing.T) {
 		[]float64{0 - 0.000482985965138744, -0.0008840068279246431, -0.000482985965138744, -0.0008840068279246431, -0.000482985965138744, -0.0008840068279246431, -0.02127463868926193, -0.02127463868926193, -0.02127463868926193, -0.02127463868926193, -0.02127463868926193, -0.02127463868926193, -1.028407250015801, -1.028407250015801, -0.03246195834709224, -0.03246195834709224, -1.026329069984532, -1.026329069984532},
 		[][]float64{{0.9640275800758169, 0.9640275800758169, 0.9640275800758169, 0.9938671116374396, 0.9938671116374396}, {0.9950547536867305, 0.9950547536867305, 0.9950547536867305, 0.9949062016530742, 0.9949062016530742}, {0.9950547536867305, 0.9950547536867305, 0.9950547536867305, 0.9949062016530742, 0.9949062016530742}})
 
-	best_nn := FitByCG(structure.ForWeights, sample_x, sample_t, w0, false, 1e-12, 1000)
+	best_nn := mustFit(t, structure.ForWeights, sample_x, sample_t, w0, 1000)
 	ExpectNN(
 		t, sample_x, sample_t, best_nn,
 		[]float64{-1.3630863383661246e-05, 0.43681311195274314, -1.3630863383661246e-05, 0.43681311195274314, -1.3630863383661246e-05, 0.43681311195274314, 0.6035930751398187, 0.6035930751398187, 0.6035930751398187, 0.6035930751398187, 0.6035930751398187, 0.6035930751398187, 1.6652442959580869, 1.6652442959580869, 1.385667784689702, 1.385667784689702, 1.6652536030673724, 1.6652536030673724},
@@ -61,31 +64,644 @@ func TestMultiLayerNetwork(t *testing.T) {
 }
 
 func TestGradientsInMultiLayerNetworkEqualApproximation(t *testing.T) {
-	order := NNOrder{2, []int{3, 2}, 3}
+	order := NNOrder{D: 2, M: []int{3, 2}, K: 3, NoBias: true}
 	random_w0 := []float64{0.6046602879796196, 0.9405090880450124, 0.6645600532184904, 0.4377141871869802, 0.4246374970712657, 0.6868230728671094, 0.06563701921747622, 0.15651925473279124, 0.09696951891448456, 0.30091186058528707, 0.5152126285020654, 0.8136399609900968, 0.21426387258237492, 0.380657189299686, 0.31805817433032985, 0.4688898449024232, 0.28303415118044517, 0.29310185733681576}
 
 	single_x := []float64{1, 1}
 	single_t := []float64{2, 2, 2}
 
-	RunTestForNNGradients(t, order.OfResponseType(Regression).ForWeights, random_w0, single_x, single_t)
+	RunTestForNNGradients(t, mustStructure(t, order, Regression).ForWeights, random_w0, single_x, single_t)
 
-	RunTestForNNGradients(t, order.OfResponseType(BinaryClassifier).ForWeights, random_w0, single_x, single_t)
+	RunTestForNNGradients(t, mustStructure(t, order, BinaryClassifier).ForWeights, random_w0, single_x, single_t)
 }
 
 func TestGradientsInSingleLayerNetworkEqualApproximation(t *testing.T) {
-	order := NNOrder{2, []int{5}, 3}
+	order := NNOrder{D: 2, M: []int{5}, K: 3, NoBias: true}
 	random_w0 := []float64{0.6790846759202163, 0.21855305259276428, 0.20318687664732285, 0.360871416856906, 0.5706732760710226, 0.8624914374478864, 0.29311424455385804, 0.29708256355629153, 0.7525730355516119, 0.2065826619136986, 0.865335013001561, 0.6967191657466347, 0.5238203060500009, 0.028303083325889995, 0.15832827774512764, 0.6072534395455154, 0.9752416188605784, 0.07945362337387198, 0.5948085976830626, 0.05912065131387529, 0.692024587353112, 0.30152268100656, 0.17326623818270528, 0.5410998550087353, 0.544155573000885}
 
 	single_x := []float64{1, 1}
 	single_t := []float64{2, 2, 2}
 
-	RunTestForNNGradients(t, order.OfResponseType(Regression).SNForWeights, random_w0, single_x, single_t)
+	RunTestForNNGradients(t, mustStructure(t, order, Regression).SNForWeights, random_w0, single_x, single_t)
 
-	RunTestForNNGradients(t, order.OfResponseType(BinaryClassifier).SNForWeights, random_w0, single_x, single_t)
+	RunTestForNNGradients(t, mustStructure(t, order, BinaryClassifier).SNForWeights, random_w0, single_x, single_t)
 }
 
-func RunTestForNNGradients(t *testing.T, builderFun func(WeightVector) NeuralNetwork, w0 []float64, single_x XVector, single_t YVector) {
-	nn := builderFun(w0)
+func TestGradientsWithBiasesEqualApproximation(t *testing.T) {
+	rnd := rand.New(rand.NewSource(11))
+	single_x := []float64{1, -1}
+	single_t := []float64{2, 0, 1}
+
+	for _, order := range []NNOrder{{D: 2, M: []int{3, 2}, K: 3}, {D: 2, M: []int{4}, K: 3}} {
+		expectGradientsEqualApproximation(t, mustStructure(t, order, Regression), rnd, single_x, single_t)
+	}
+}
+
+func TestGradientsWithEveryActivationEqualApproximation(t *testing.T) {
+	rnd := rand.New(rand.NewSource(12))
+	single_x := []float64{1, -1}
+	single_t := []float64{2, 0, 1}
+
+	for activation := range activationFunctions {
+		order := NNOrder{D: 2, M: []int{3, 2}, K: 3, Activations: []Activation{activation, Tanh}}
+		w0 := expectGradientsEqualApproximation(t, mustStructure(t, order, Regression), rnd, single_x, single_t)
+
+		order.Activations = []Activation{Logistic, activation}
+		RunTestForNNGradients(t, mustStructure(t, order, Regression).ForWeights, w0, single_x, single_t)
+	}
+}
+
+func TestActivationsAreValidated(t *testing.T) {
+	err := (&NNOrder{D: 2, M: []int{3, 2}, K: 3, Activations: []Activation{"swish"}}).Validate()
+	if errs, ok := err.(InputErrors); !ok || len(errs) != 2 || errs[0].Field != "Order.Activations" || errs[1].Row != 0 {
+		t.Errorf("expected errors on the count and the name of the activations, got %v", err)
+	}
+}
+
+func TestMulticlassGradientsEqualApproximation(t *testing.T) {
+	rnd := rand.New(rand.NewSource(13))
+	single_x := []float64{1, -1}
+	single_t := []float64{0, 1, 0}
+
+	for _, order := range []NNOrder{{D: 2, M: []int{3, 2}, K: 3}, {D: 2, M: []int{4}, K: 3}} {
+		expectGradientsEqualApproximation(t, mustStructure(t, order, MulticlassClassifier), rnd, single_x, single_t)
+	}
+}
+
+func TestMulticlassTargetsAcceptClassLabels(t *testing.T) {
+	structure := mustStructure(t, NNOrder{D: 2, M: []int{4}, K: 3}, MulticlassClassifier)
+	targets, err := structure.Targets(nil, YSample{{2}, {0, 1, 0}, {0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqualSampleArrays(t, AsArray(targets), [][]float64{{0, 0, 1}, {0, 1, 0}, {1, 0, 0}}, 0, "one-hot targets")
+
+	if _, err := structure.Targets(nil, YSample{{1.5}, {3}}); err == nil || len(err.(InputErrors)) != 2 {
+		t.Errorf("expected errors for a fractional and an out of range label, got %v", err)
+	}
+	if _, err := (NNOrder{D: 2, M: []int{4}, K: 1}).OfResponseType(MulticlassClassifier); err == nil {
+		t.Errorf("expected an error for a single class")
+	}
+
+	sample_x := XSample{{1, 0}, {0, 1}, {-1, -1}}
+	targets, _ = structure.Targets(sample_x, YSample{{0}, {1}, {2}})
+	nn := mustFit(t, structure.ForWeights, sample_x, targets, randomWeights(t, structure, rand.New(rand.NewSource(13))), 1000)
+	for i, y := range PredictSample(nn, sample_x) {
+		if math.Abs(floats.Sum(y)-1) > 1e-12 || floats.MaxIdx(y) != i {
+			t.Errorf("expected probabilities of class %d to be highest, got %v", i, y)
+		}
+	}
+}
+
+func TestCountGradientsEqualApproximation(t *testing.T) {
+	rnd := rand.New(rand.NewSource(14))
+	single_x := []float64{1, -1}
+	single_t := []float64{0, 3, 1}
+
+	for _, responseType := range []NetworkResponseType{Poisson, NegativeBinomial} {
+		for _, order := range []NNOrder{{D: 2, M: []int{3, 2}, K: 3}, {D: 2, M: []int{4}, K: 3}} {
+			expectGradientsEqualApproximation(t, mustStructure(t, order, responseType), rnd, single_x, single_t)
+		}
+	}
+}
+
+func TestNegativeBinomialFitsItsDispersion(t *testing.T) {
+	structure := mustStructure(t, NNOrder{D: 1, M: []int{2}, K: 1}, NegativeBinomial)
+	if count := mustWeightsCount(t, structure); count != 8 {
+		t.Errorf("expected the 7 network weights and the dispersion, got %d", count)
+	}
+
+	// counts of mean 4 and variance 7.25, i.e. a moment estimate of theta = 4^2 / (7.25 - 4) = 4.9
+	sample_x := XSample{{0}, {0}, {0}, {0}, {0}, {0}, {0}, {0}}
+	sample_t := YSample{{0}, {1}, {2}, {4}, {4}, {6}, {7}, {8}}
+	nn := mustFit(t, structure.ForWeights, sample_x, sample_t, ArrayOfSize(8, 0.1), 1000)
+
+	if mean := PredictSample(nn, sample_x)[0][0]; math.Abs(mean-4) > 1e-3 {
+		t.Errorf("expected the sample mean 4, got %f", mean)
+	}
+	if theta := math.Exp(nn.PackedWts()[7]); theta < 2 || theta > 10 {
+		t.Errorf("expected a dispersion in the order of the moment estimate 4.9, got %f", theta)
+	}
+	if err := structure.ValidateSample(sample_x, YSample{{-1}, {1}, {2}, {4}, {4}, {6}, {7}, {8}}); err == nil {
+		t.Errorf("expected an error for a negative count")
+	}
+}
+
+func TestRobustLossGradientsEqualApproximation(t *testing.T) {
+	rnd := rand.New(rand.NewSource(15))
+	single_x := []float64{1, -1}
+	single_t := []float64{2, 0, -3}
+
+	for _, responseType := range []NetworkResponseType{Huber, Absolute, Quantile} {
+		for _, order := range []NNOrder{{D: 2, M: []int{3, 2}, K: 3}, {D: 2, M: []int{4}, K: 3}} {
+			structure, err := order.OfResponse(responseType, ResponseParams{Quantile: 0.8, HuberDelta: 1.5})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectGradientsEqualApproximation(t, structure, rnd, single_x, single_t)
+		}
+	}
+}
+
+func TestQuantileNetworkFitsTheQuantile(t *testing.T) {
+	structure, err := NNOrder{D: 1, M: []int{2}, K: 1}.OfResponse(Quantile, ResponseParams{Quantile: 0.8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample_x := XSample{{0}, {0}, {0}, {0}, {0}, {0}, {0}, {0}, {0}, {0}}
+	sample_t := YSample{{1}, {2}, {3}, {4}, {5}, {6}, {7}, {8}, {9}, {100}}
+	nn := mustFit(t, structure.ForWeights, sample_x, sample_t, ArrayOfSize(mustWeightsCount(t, structure), 0.1), 1000)
+	if y := PredictSample(nn, sample_x)[0][0]; y < 8 || y > 9 {
+		t.Errorf("expected a prediction between the 8th and 9th of 10 targets, got %f", y)
+	}
+
+	for _, invalid := range []ResponseParams{{Quantile: 1}, {Quantile: -0.5}, {HuberDelta: -1}} {
+		if _, err := (NNOrder{D: 1, M: []int{2}, K: 1}).OfResponse(Huber, invalid); err == nil {
+			t.Errorf("expected %+v to be refused", invalid)
+		}
+	}
+}
+
+func TestAnyPairingOfSigmaAndErrorFunctionBackpropagates(t *testing.T) {
+	rnd := rand.New(rand.NewSource(16))
+	order := NNOrder{D: 2, M: []int{3, 2}, K: 3}
+	single_x := []float64{1, -1}
+	single_t := []float64{0.1, 0.9, 0} // sums to 1, as the targets of multiclass networks must
+
+	// sigmoid outputs with squared error, given their derivatives and then approximating them
+	structure := mustStructure(t, order, BinaryClassifier)
+	w0 := randomWeights(t, structure, rnd)
+	structure.ErrorFunction = func(y YVector, t YVector) float64 { return ssqdiff(y, t) / 2 }
+	structure.ErrorDerivative, structure.Canonical = residuals, false
+	RunTestForNNGradients(t, structure.ForWeights, w0, single_x, single_t)
+	structure.ErrorDerivative, structure.SigmaPrim = nil, nil
+	RunTestForNNGradients(t, structure.ForWeights, w0, single_x, single_t)
+
+	// structures built by hand, leaving the number of outputs to default to K
+	for _, handOrder := range []NNOrder{order, {D: 2, M: []int{4}, K: 3}} {
+		tanh := activationFunctions[Tanh]
+		handBuilt := &NNStructure{NNOrder: handOrder, Sigma: elementwise(sigmoid),
+			ErrorFunction: func(y YVector, t YVector) float64 { return ssqdiff(y, t) / 2 }}
+		for range handOrder.M {
+			handBuilt.H, handBuilt.H_prim = append(handBuilt.H, tanh.h), append(handBuilt.H_prim, tanh.h_prim)
+		}
+		expectGradientsEqualApproximation(t, handBuilt, rnd, single_x, single_t)
+	}
+
+	// the canonical shortcut agrees with applying the derivatives
+	for _, responseType := range []NetworkResponseType{Regression, BinaryClassifier, MulticlassClassifier, Poisson} {
+		canonical := mustStructure(t, order, responseType)
+		general := mustStructure(t, order, responseType)
+		general.Canonical = false
+		ExpectEqualArrays(t, mustNetwork(t, general.ForWeights, w0).Gradient(single_x, single_t),
+			mustNetwork(t, canonical.ForWeights, w0).Gradient(single_x, single_t), 1e-10, string(responseType)+" gradient")
+	}
+}
+
+func TestGaussianGradientsEqualApproximation(t *testing.T) {
+	rnd := rand.New(rand.NewSource(17))
+	single_x := []float64{1, -1}
+	single_t := []float64{2, 0, -1}
+
+	for _, order := range []NNOrder{{D: 2, M: []int{3, 2}, K: 3}, {D: 2, M: []int{4}, K: 3}} {
+		expectGradientsEqualApproximation(t, mustStructure(t, order, Gaussian), rnd, single_x, single_t)
+	}
+}
+
+func TestGaussianNetworkPredictsMeansAndStandardDeviations(t *testing.T) {
+	structure := mustStructure(t, NNOrder{D: 1, M: []int{2}, K: 1}, Gaussian)
+	if count := mustWeightsCount(t, structure); count != 10 {
+		t.Errorf("expected 2+2 weights into the hidden layer and 4+2 into the mean and log-variance outputs, got %d", count)
+	}
+
+	sample_x := XSample{{0}, {0}, {0}, {0}}
+	sample_t := YSample{{1}, {3}, {1}, {3}}
+	nn := mustFit(t, structure.ForWeights, sample_x, sample_t, ArrayOfSize(10, 0.1), 1000)
+	means, stddevs := MomentsSample(structure, nn, sample_x)
+	if math.Abs(means[0][0]-2) > 1e-3 || math.Abs(stddevs[0][0]-1) > 1e-3 {
+		t.Errorf("expected the mean 2 and the standard deviation 1 of the sample, got %v and %v", means[0], stddevs[0])
+	}
+}
+
+func TestMixtureDensityGradientsEqualApproximation(t *testing.T) {
+	rnd := rand.New(rand.NewSource(18))
+	single_x := []float64{1, -1}
+	single_t := []float64{0.5, -1}
+
+	for _, order := range []NNOrder{{D: 2, M: []int{3, 2}, K: 2}, {D: 2, M: []int{4}, K: 2}} {
+		structure, err := order.OfResponse(MixtureDensity, ResponseParams{Components: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectGradientsEqualApproximation(t, structure, rnd, single_x, single_t)
+	}
+}
+
+func TestMixtureDensityNetworkKeepsModesApart(t *testing.T) {
+	structure, err := NNOrder{D: 1, M: []int{3}, K: 1}.OfResponse(MixtureDensity, ResponseParams{Components: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if structure.Outputs != 6 {
+		t.Errorf("expected 2 mixing coefficients, 2 means and 2 variances, got %d outputs", structure.Outputs)
+	}
+
+	var sample_x XSample
+	var sample_t YSample
+	for i := 0; i < 20; i++ {
+		sample_x = append(sample_x, XVector{0})
+		sample_t = append(sample_t, YVector{float64(i%2*4-2) + float64(i%5)/10})
+	}
+	rnd := rand.New(rand.NewSource(18))
+	nn := mustFit(t, structure.ForWeights, sample_x, sample_t, randomWeights(t, structure, rnd), 2000)
+
+	mixture := structure.MixtureOf(nn.Predict(sample_x[0]))
+	if mean := mixture.Mean(); math.Abs(mean[0]-0.2) > 0.05 {
+		t.Errorf("expected the mean of the sample, 0.2, got %f", mean[0])
+	}
+	if mode := mixture.Mode(); math.Min(math.Abs(mode[0]+1.8), math.Abs(mode[0]-2.2)) > 0.1 {
+		t.Errorf("expected a mode at one of the clusters around -1.8 and 2.2, got %f", mode[0])
+	}
+	near := 0
+	for i := 0; i < 100; i++ {
+		if draw := mixture.Sample(rnd); math.Abs(math.Abs(draw[0]-0.2)-2) < 0.5 {
+			near++
+		}
+	}
+	if near < 90 {
+		t.Errorf("expected draws around the clusters, got %d of 100", near)
+	}
+	if structure.MixtureOf(nn.Predict(sample_x[0])) == nil || mustStructure(t, NNOrder{D: 1, M: []int{3}, K: 1}, Gaussian).MixtureOf(YVector{0, 0}) != nil {
+		t.Errorf("expected mixtures of mixture density networks only")
+	}
+}
+
+func TestMissingTargetsAddNothing(t *testing.T) {
+	rnd := rand.New(rand.NewSource(20))
+	single_x := []float64{1, -1}
+	nan := math.NaN()
+
+	for _, responseType := range []NetworkResponseType{Regression, BinaryClassifier, NegativeBinomial, Quantile, Gaussian, MixtureDensity} {
+		structure := mustStructure(t, NNOrder{D: 2, M: []int{3, 2}, K: 3}, responseType)
+		w0 := expectGradientsEqualApproximation(t, structure, rnd, single_x, YVector{1, nan, 0})
+
+		nn := mustNetwork(t, structure.ForWeights, w0)
+		missing := YVector{nan, nan, nan}
+		if erf := nn.ErfValue(single_x, missing); erf != 0 {
+			t.Errorf("%s: expected no error without targets, got %g", responseType, erf)
+		}
+		ExpectEqualArrays(t, nn.Gradient(single_x, missing), make([]float64, len(w0)), 0, string(responseType)+" gradient without targets")
+	}
+
+	// a missing target of a mixture is marginalized: the density of the others is the one of a mixture over them
+	structure := mustStructure(t, NNOrder{D: 2, M: []int{3}, K: 2}, MixtureDensity)
+	nn := mustNetwork(t, structure.ForWeights, fillRandom(mustWeightsCount(t, structure)))
+	mixture := structure.MixtureOf(nn.Predict(single_x))
+	_, logDensity := (&Mixture{mixture.Weights, [][]float64{{mixture.Means[0][0]}, {mixture.Means[1][0]}, {mixture.Means[2][0]}}, mixture.Variances}).responsibilities([]float64{0.5})
+	if erf := nn.ErfValue(single_x, YVector{0.5, nan}); math.Abs(erf+logDensity) > 1e-9 {
+		t.Errorf("expected the negative log of the marginal density %g, got %g", -logDensity, erf)
+	}
+}
+
+func TestMissingTargetsAreValidated(t *testing.T) {
+	nan := math.NaN()
+	structure := mustStructure(t, NNOrder{D: 1, M: []int{2}, K: 2}, Regression)
+	if err := structure.ValidateSample(XSample{{1}, {2}}, YSample{{nan, 1}, {nan, nan}}); err != nil {
+		t.Errorf("expected NaN targets to be missing ones, got %v", err)
+	}
+	if err := structure.ValidateSample(XSample{{nan}}, YSample{{math.Inf(1), 1}}); err == nil || len(err.(InputErrors)) != 2 {
+		t.Errorf("expected NaN inputs and infinite targets to be reported, got %v", err)
+	}
+
+	multiclass := mustStructure(t, NNOrder{D: 1, M: []int{2}, K: 3}, MulticlassClassifier)
+	targets, err := multiclass.Targets(nil, YSample{{nan}, {1}})
+	if err != nil || !math.IsNaN(targets[0][2]) || targets[1][1] != 1 {
+		t.Errorf("expected a missing label to miss every class, got %v, %v", targets, err)
+	}
+	if err := multiclass.ValidateSample(XSample{{1}, {2}}, YSample{{nan, nan, nan}, {nan, 1, 0}}); err == nil || err.(InputErrors)[0].Row != 1 {
+		t.Errorf("expected a row missing some classes to be reported, got %v", err)
+	}
+
+	masked, err := MaskTargets(YSample{{1, 2}, {3, 4}}, [][]bool{{true, false}, {false, true}})
+	if err != nil || !math.IsNaN(masked[0][1]) || !math.IsNaN(masked[1][0]) || masked[1][1] != 4 {
+		t.Errorf("expected the unobserved targets to be NaN, got %v, %v", masked, err)
+	}
+	if _, err := MaskTargets(YSample{{1, 2}, {3, 4}}, [][]bool{{true}, {true, true}}); err == nil || err.(InputErrors)[0].Row != 0 {
+		t.Errorf("expected a mask row of the wrong width to be reported, got %v", err)
+	}
+}
+
+func TestBiasesFitAConstantOffset(t *testing.T) {
+	order := NNOrder{D: 1, M: []int{2}, K: 1}
+	if count := order.packedWeightsCount(); count != 7 {
+		t.Errorf("expected 2+2 weights and biases into the hidden layer and 2+1 into the output, got %d", count)
+	}
+
+	structure := mustStructure(t, order, Regression)
+	sample_x := XSample{{0}, {0}}
+	sample_t := YSample{{5}, {5}}
+	w0 := ArrayOfSize(mustWeightsCount(t, structure), 0.1)
+	for _, networkFor := range []func(WeightVector) (NeuralNetwork, error){structure.ForWeights, structure.SNForWeights} {
+		nn := mustFit(t, networkFor, sample_x, sample_t, w0, 1000)
+		if erf := ErfSampleValue(nn, sample_x, sample_t); erf > 1e-6 {
+			t.Errorf("expected a network with biases to fit a constant, error is %g", erf)
+		}
+	}
+}
+
+func TestSampleWeightsCountRowsAsOftenAsTheyWeigh(t *testing.T) {
+	structure := mustStructure(t, NNOrder{D: 2, M: []int{3}, K: 1}, Regression)
+	nn := mustNetwork(t, structure.ForWeights, fillRandom(mustWeightsCount(t, structure)))
+	sample_x := XSample{{1, 2}, {-1, 0.5}}
+	sample_t := YSample{{1}, {-2}}
+	weights := []float64{2, 0.5}
+
+	twice_x := XSample{sample_x[0], sample_x[0]}
+	twice_t := YSample{sample_t[0], sample_t[0]}
+	expected := ErfSampleValue(nn, twice_x, twice_t) + 0.5*nn.ErfValue(sample_x[1], sample_t[1])
+	if erf := WeightedErfSampleValue(nn, sample_x, sample_t, weights); math.Abs(erf-expected) > 1e-9 {
+		t.Errorf("expected a weighted error of %g, got %g", expected, erf)
+	}
+	expectedGradient := GradientSample(nn, twice_x, twice_t)
+	floats.AddScaled(expectedGradient, 0.5, nn.Gradient(sample_x[1], sample_t[1]))
+	ExpectEqualArrays(t, WeightedGradientSample(nn, sample_x, sample_t, weights), expectedGradient, 1e-9, "weighted gradient")
+
+	if err := ValidateSampleWeights([]float64{1, -1, 1}, 2); err == nil || len(err.(InputErrors)) != 2 {
+		t.Errorf("expected the count and the negative weight to be reported, got %v", err)
+	}
+	if _, err := FitByCG(context.Background(), structure.ForWeights, sample_x, sample_t, []float64{1}, nn.PackedWts(), FitOptions{}, nil); err == nil {
+		t.Errorf("expected a fit with a weight missing to fail")
+	}
+}
+
+func TestSkipGradientsEqualApproximation(t *testing.T) {
+	rnd := rand.New(rand.NewSource(21))
+	single_x := []float64{1, -1}
+	single_t := []float64{0.5, -0.5}
+
+	for _, order := range []NNOrder{
+		{D: 2, M: []int{3, 2}, K: 2, Skips: []Skip{{0, 3}, {1, 3}, {0, 2}}},
+		{D: 2, M: []int{4}, K: 2, Skips: []Skip{{0, 2}}},
+		{D: 2, M: []int{4}, K: 2, Skips: []Skip{{0, 2}}, NoBias: true},
+	} {
+		for _, responseType := range []NetworkResponseType{Regression, Gaussian} {
+			expectGradientsEqualApproximation(t, mustStructure(t, order, responseType), rnd, single_x, single_t)
+		}
+	}
+}
+
+func TestSkipsFitALinearTrend(t *testing.T) {
+	order := NNOrder{D: 1, M: []int{2}, K: 1, Skips: []Skip{{0, 2}}}
+	if count := order.packedWeightsCount(); count != 8 {
+		t.Errorf("expected 7 weights of the layers and 1 of the skip, got %d", count)
+	}
+
+	structure := mustStructure(t, order, Regression)
+	sample_x := XSample{{-3}, {-1}, {0}, {2}, {5}}
+	sample_t := YSample{{-5}, {-1}, {1}, {5}, {11}}
+	w0 := make([]float64, mustWeightsCount(t, structure))
+	for _, networkFor := range []func(WeightVector) (NeuralNetwork, error){structure.ForWeights, structure.SNForWeights} {
+		nn := mustFit(t, networkFor, sample_x, sample_t, w0, 1000)
+		if erf := ErfSampleValue(nn, sample_x, sample_t); erf > 1e-6 {
+			t.Errorf("expected the skip to fit a line with hidden units left at 0, error is %g", erf)
+		}
+		if skip := nn.PackedWts()[7]; math.Abs(skip-2) > 1e-3 {
+			t.Errorf("expected the skip to carry the slope 2, got %g", skip)
+		}
+		if hidden := nn.Hidden(sample_x[0]); len(hidden) != 2 {
+			t.Errorf("expected the hidden units alone, got %v", hidden)
+		}
+	}
+
+	invalid := NNOrder{D: 1, M: []int{2}, K: 1, Skips: []Skip{{0, 1}, {0, 3}, {0, 2}, {0, 2}}}
+	if err := invalid.Validate(); err == nil || len(err.(InputErrors)) != 3 {
+		t.Errorf("expected a skip to the next layer, one past the output and a repeated one to be reported, got %v", err)
+	}
+}
+
+func TestMaskedWeightsStayPut(t *testing.T) {
+	sample_x := XSample{{-1, 0}, {0, 1}, {1, 1}, {2, -1}}
+	sample_t := YSample{{1}, {0}, {2}, {-1}}
+
+	for _, order := range []NNOrder{{D: 2, M: []int{3}, K: 1}, {D: 2, M: []int{3, 2}, K: 1, Skips: []Skip{{0, 3}}}} {
+		structure := mustStructure(t, order, Regression)
+		count := mustWeightsCount(t, structure)
+		structure.Mask = make(WeightMask, count)
+		for i := range structure.Mask {
+			structure.Mask[i] = Trainable
+		}
+		structure.Mask[0], structure.Mask[1], structure.Mask[count-1] = Frozen, Absent, Absent
+		w0 := fillRandom(count)
+		w0[0], w0[1], w0[count-1] = 0.7, 0.3, -0.4
+
+		networkFors := []func(WeightVector) (NeuralNetwork, error){structure.ForWeights}
+		if len(order.M) == 1 {
+			networkFors = append(networkFors, structure.SNForWeights)
+		}
+		for _, networkFor := range networkFors {
+			nn := mustNetwork(t, networkFor, w0)
+			gradient := GradientSample(nn, sample_x, sample_t)
+			if gradient[0] != 0 || gradient[1] != 0 || gradient[count-1] != 0 || gradient[2] == 0 {
+				t.Errorf("expected no gradient by frozen and absent weights, got %v", gradient)
+			}
+
+			fitted := mustFit(t, networkFor, sample_x, sample_t, w0, 100).PackedWts()
+			if fitted[0] != 0.7 || fitted[1] != 0 || fitted[count-1] != 0 {
+				t.Errorf("expected the frozen weight to keep its value and the absent ones to be 0, got %v", fitted)
+			}
+			if floats.Equal(fitted[2:count-1], w0[2:count-1]) {
+				t.Errorf("expected the trainable weights to be fitted")
+			}
+		}
+
+		structure.Mask[2] = "melted"
+		if err := structure.ValidateWeights(w0[1:]); err == nil || len(err.(InputErrors)) != 2 || err.(InputErrors)[1].Row != 2 {
+			t.Errorf("expected the weights count and the unknown state to be reported, got %v", err)
+		}
+	}
+}
+
+func TestTiedWeightsShareAParameter(t *testing.T) {
+	structure := mustStructure(t, NNOrder{D: 2, M: []int{3}, K: 1}, Regression)
+	count := mustWeightsCount(t, structure)
+	structure.Ties = WeightTies{{0, 3}, {1, 2, 4}}
+	w0 := fillRandom(count)
+	single_x, single_t := XVector{1, -2}, YVector{0.5}
+
+	untied := mustStructure(t, structure.NNOrder, Regression)
+	nn := mustNetwork(t, structure.ForWeights, w0)
+	tiedWts := nn.PackedWts()
+	if tiedWts[3] != w0[0] || tiedWts[2] != w0[1] || tiedWts[4] != w0[1] || tiedWts[5] != w0[5] {
+		t.Errorf("expected tied weights to take the value of the first of their group, got %v", tiedWts)
+	}
+	gradient, separate := nn.Gradient(single_x, single_t), mustNetwork(t, untied.ForWeights, tiedWts).Gradient(single_x, single_t)
+	if math.Abs(gradient[4]-(separate[1]+separate[2]+separate[4])) > 1e-12 || gradient[1] != gradient[4] || gradient[5] != separate[5] {
+		t.Errorf("expected the gradient by tied weights to be the sum over their group, got %v for %v", gradient, separate)
+	}
+
+	params := structure.Parameters(w0)
+	if len(params) != count-3 || params[0] != w0[0] || params[1] != w0[1] || params[2] != w0[5] {
+		t.Errorf("expected one parameter per group and untied weight, got %v", params)
+	}
+	ExpectEqualArrays(t, structure.Weights(params), tiedWts, 0, "weights of the parameters")
+	RunTestForNNGradients(t, structure.ForParameters, params, single_x, single_t)
+
+	sample_x := XSample{{1, -2}, {0, 1}, {2, 2}}
+	sample_t := YSample{{0.5}, {-1}, {1}}
+	fitted, err := FitByCG(context.Background(), structure.ForParameters, sample_x, sample_t, nil, params, FitOptions{MaxIter: 50}, nil)
+	if err != nil || len(fitted.PackedWts()) != len(params) {
+		t.Fatalf("expected a fit of the parameters, got %v", err)
+	}
+	if wts := structure.Weights(fitted.PackedWts()); wts[0] != wts[3] || wts[1] != wts[2] || wts[1] != wts[4] {
+		t.Errorf("expected the fitted weights to stay tied, got %v", wts)
+	}
+
+	structure.Ties = WeightTies{{0}, {1, 2, count}, {2, 5}}
+	structure.Mask = make(WeightMask, count)
+	for i := range structure.Mask {
+		structure.Mask[i] = Trainable
+	}
+	structure.Mask[5] = Frozen
+	if err := structure.ValidateWeights(w0); err == nil || fmt.Sprint(err.(InputErrors)[1:]) != fmt.Sprint(InputErrors{inputErrorAt("Ties", 1, 2, "no weight %d among the %d weights", count, count), inputErrorAt("Ties", 2, 0, "weight 2 is already tied"), inputErrorAt("Ties", 2, 1, "weight 5 is frozen, unlike weight 2")}) {
+		t.Errorf("expected a single weight, one out of range, a repeated one and mixed states to be reported, got %v", err)
+	}
+
+	structure.Ties = WeightTies{{count + 99, 1}}
+	if err := structure.ValidateWeights(w0); err == nil || fmt.Sprint(err) != fmt.Sprint(InputErrors{inputErrorAt("Ties", 0, 0, "no weight %d among the %d weights", count+99, count)}) {
+		t.Errorf("expected the first weight of the group to be reported out of range, got %v", err)
+	}
+}
+
+func TestConvolutionGradientsEqualApproximation(t *testing.T) {
+	rnd := rand.New(rand.NewSource(24))
+	single_x := make([]float64, 12)
+	for i := range single_x {
+		single_x[i] = rnd.Float64()*2 - 1
+	}
+
+	for _, pooling := range []Pooling{MaxPooling, AveragePooling} {
+		order := NNOrder{D: 12, M: []int{3}, K: 2, InputChannels: 2, Skips: []Skip{{0, 2}}, Convolutions: []ConvLayer{
+			{Kernel: 3, Channels: 3, Padding: 1},
+			{Kernel: 2, Stride: 2, Pool: pooling},
+			{Kernel: 2, Channels: 2, Activation: Softplus},
+		}}
+		structure := mustStructure(t, order, Regression)
+		if count := mustWeightsCount(t, structure); count != 21+14+15+8+8 {
+			t.Errorf("expected 21 and 14 weights of the convolutions, 15+8 of the dense layers and 8 of the skip, got %d", count)
+		}
+		w0 := expectGradientsEqualApproximation(t, structure, rnd, single_x, YVector{0.5, -0.5})
+		if hidden := mustNetwork(t, structure.ForWeights, w0).Hidden(single_x); len(hidden) != 18+9+4+3 {
+			t.Errorf("expected the outputs of the convolutions and the hidden units, got %d", len(hidden))
+		}
+	}
+}
+
+func TestConvolutionsSlideOverTheInputs(t *testing.T) {
+	order := NNOrder{D: 4, M: []int{1}, K: 1, NoBias: true, Activations: []Activation{Linear},
+		Convolutions: []ConvLayer{{Kernel: 2, Channels: 1, Activation: Linear}}}
+	structure := mustStructure(t, order, Regression)
+	nn := mustNetwork(t, structure.ForWeights, WeightVector{1, -1, 1, 1, 1, 2})
+	ExpectEqualArrays(t, nn.Hidden(XVector{1, 2, 4, 8}), []float64{-1, -2, -4, -7}, 1e-12, "differences of the inputs and their sum")
+	ExpectEqualArrays(t, nn.Predict(XVector{1, 2, 4, 8}), []float64{-14}, 1e-12, "prediction")
+
+	for _, conv := range []ConvLayer{{Kernel: 5, Channels: 1}, {Kernel: 2}, {Kernel: 2, Pool: "min"}, {Kernel: 2, Pool: MaxPooling, Padding: 1}} {
+		invalid := NNOrder{D: 4, M: []int{1}, K: 1, Convolutions: []ConvLayer{conv}}
+		if err := invalid.Validate(); err == nil || err.(InputErrors)[0].Field != "Order.Convolutions" {
+			t.Errorf("expected %+v to be reported, got %v", conv, err)
+		}
+	}
+	if err := (&NNOrder{D: 5, M: []int{1}, K: 1, InputChannels: 2}).Validate(); err == nil {
+		t.Errorf("expected 5 inputs not to split into 2 channels")
+	}
+	if _, err := structure.SNForWeights(nn.PackedWts()); err == nil {
+		t.Errorf("expected a single layer network to refuse convolutions")
+	}
+}
+
+func TestRecurrentGradientsEqualApproximation(t *testing.T) {
+	rnd := rand.New(rand.NewSource(25))
+	sequence := XSequences{{{1, -1, 0.5, 0}, {0.5, 0, -1, 1}, {-0.5, 1, 0, 0.5}}}.Flatten()[0]
+
+	for _, order := range []NNOrder{
+		{D: 4, M: []int{3, 2}, K: 2, Recurrent: &RecurrentLayer{}},
+		{D: 4, M: []int{3, 2}, K: 2, Recurrent: &RecurrentLayer{EveryStep: true}, Skips: []Skip{{0, 3}}},
+		{D: 4, M: []int{3}, K: 2, Recurrent: &RecurrentLayer{EveryStep: true}, Convolutions: []ConvLayer{{Kernel: 2, Channels: 2}}},
+	} {
+		for _, responseType := range []NetworkResponseType{Regression, NegativeBinomial} {
+			structure := mustStructure(t, order, responseType)
+			targets := YVector{1, 2}
+			if order.Recurrent.EveryStep {
+				targets = YVector{1, 2, 0, 1, 3, 0}
+			}
+			w0 := expectGradientsEqualApproximation(t, structure, rnd, sequence, targets)
+			if y := mustNetwork(t, structure.ForWeights, w0).Predict(sequence); len(y) != len(targets) {
+				t.Errorf("expected %d outputs, got %v", len(targets), y)
+			}
+		}
+	}
+}
+
+func TestRecurrentNetworkRemembersTheSequence(t *testing.T) {
+	order := NNOrder{D: 1, M: []int{1}, K: 1, NoBias: true, Activations: []Activation{Linear}, Recurrent: &RecurrentLayer{}}
+	if count := order.packedWeightsCount(); count != 3 {
+		t.Errorf("expected a weight into the hidden unit, one out of it and one back into it, got %d", count)
+	}
+	structure := mustStructure(t, order, Regression)
+	sample_x := XSequences{{{1}, {2}, {3}}, {{-1}, {0.5}}, {{2}, {-1}, {0.5}, {1}}}.Flatten()
+	sample_t := YSample{{6}, {-0.5}, {2.5}}
+
+	nn := mustFit(t, structure.ForWeights, sample_x, sample_t, WeightVector{0.5, 0.5, 0.5}, 1000)
+	if erf := ErfSampleValue(nn, sample_x, sample_t); erf > 1e-6 {
+		t.Errorf("expected the network to sum up the sequences, error is %g with weights %v", erf, nn.PackedWts())
+	}
+
+	truncated := mustStructure(t, NNOrder{D: 1, M: []int{1}, K: 1, NoBias: true, Activations: []Activation{Linear}, Recurrent: &RecurrentLayer{Truncate: 1}}, Regression)
+	gradient := mustNetwork(t, truncated.ForWeights, WeightVector{1, 1, 0.5}).Gradient(sample_x[0], sample_t[0])
+	// h = 1, 2.5, 4.25 and y = 4.25, but only the last step is backpropagated through
+	ExpectEqualArrays(t, gradient, []float64{-1.75 * 3, -1.75 * 4.25, -1.75 * 2.5}, 1e-12, "truncated gradient")
+}
+
+func TestSequencesAreValidated(t *testing.T) {
+	structure := mustStructure(t, NNOrder{D: 2, M: []int{3}, K: 1, Recurrent: &RecurrentLayer{EveryStep: true}}, Regression)
+	err := structure.ValidateSample(XSample{{1, 2, 3, 4}, {1, 2, 3}}, YSample{{1}, {1}})
+	if fmt.Sprint(err) != "T[0]: row has 1 values instead of 2; X[1]: a sequence needs steps of 2 inputs, got 3 values" {
+		t.Errorf("expected a sequence of the wrong length and too few targets to be reported, got %v", err)
+	}
+	if _, err := structure.SNForWeights(make(WeightVector, mustWeightsCount(t, structure))); err == nil {
+		t.Errorf("expected a single layer network to refuse to be recurrent")
+	}
+	if _, err := structure.OfResponseType(Gaussian); err == nil {
+		t.Errorf("expected gaussian networks to refuse to predict every step")
+	}
+	if err := (&NNOrder{D: 2, M: []int{3}, K: 1, Recurrent: &RecurrentLayer{Truncate: -1}}).Validate(); err == nil {
+		t.Errorf("expected a negative truncation to be reported")
+	}
+}
+
+func TestRecurrentTargetsAcceptClassLabelsOfEveryStep(t *testing.T) {
+	structure := mustStructure(t, NNOrder{D: 2, M: []int{3}, K: 3, Recurrent: &RecurrentLayer{EveryStep: true}}, MulticlassClassifier)
+	sample_x := XSequences{{{1, 0}, {0, 1}}, {{1, 1}, {0, 0}, {-1, 0}}, {{0, 1}}}.Flatten()
+	nan := math.NaN()
+	targets, err := structure.Targets(sample_x, YSample{{2, 0}, {1, nan, 0}, {0, 1, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqualSampleArrays(t, AsArray(targets[:1]), [][]float64{{0, 0, 1, 1, 0, 0}}, 0, "one-hot targets of every step")
+	if !math.IsNaN(targets[1][3]) || targets[1][1] != 1 || targets[1][6] != 1 || len(targets[2]) != 3 {
+		t.Errorf("expected a missing label to miss every class of its step only, got %v", targets)
+	}
+	if err := structure.ValidateSample(sample_x, targets); err != nil {
+		t.Errorf("expected the expanded targets to fit the sequences, got %v", err)
+	}
+	expectGradientsEqualApproximation(t, structure, rand.New(rand.NewSource(26)), sample_x[0], targets[0])
+
+	if _, err := structure.Targets(sample_x, YSample{{2, 3}}); err == nil || err.(InputErrors)[0].Col != 1 {
+		t.Errorf("expected the out of range label of the second step to be reported, got %v", err)
+	}
+}
+
+func RunTestForNNGradients(t *testing.T, builderFun func(WeightVector) (NeuralNetwork, error), w0 []float64, single_x XVector, single_t YVector) {
+	nn := mustNetwork(t, builderFun, w0)
 	gradient := nn.Gradient(single_x, single_t)
 	erf := nn.ErfValue(single_x, single_t)
 
@@ -96,7 +712,7 @@ func RunTestForNNGradients(t *testing.T, builderFun func(WeightVector) NeuralNet
 		p0[i] = 1
 
 		w1 := perturbed(w0, p0, delta)
-		nn1 := builderFun(w1)
+		nn1 := mustNetwork(t, builderFun, w1)
 		erf2 := nn1.ErfValue(single_x, single_t)
 
 		approximation[i] = (erf2 - erf) / delta
@@ -107,6 +723,236 @@ func RunTestForNNGradients(t *testing.T, builderFun func(WeightVector) NeuralNet
 	}
 }
 
+func TestInvalidInputsAreReportedAsErrors(t *testing.T) {
+	if _, err := (NNOrder{D: 2, M: []int{}, K: 3}).OfResponseType(Regression); err == nil {
+		t.Errorf("expected an error for missing hidden layers")
+	}
+	if _, err := (NNOrder{D: 2, M: []int{4, -1}, K: 3}).OfResponseType(Regression); err == nil {
+		t.Errorf("expected an error for a negative layer size")
+	}
+	if _, err := (NNOrder{D: 2, M: []int{4}, K: 3}).OfResponseType("unknown"); err == nil || err.(*InputError).Field != "NetworkRT" {
+		t.Errorf("expected an error on NetworkRT, got %v", err)
+	}
+	if _, err := (&NNOrder{D: 2, M: []int{}, K: 3}).ExpectedPackedWeightsCount(); err == nil {
+		t.Errorf("expected an error when counting weights without hidden layers")
+	}
+
+	structure := mustStructure(t, NNOrder{D: 2, M: []int{3, 2}, K: 3}, Regression)
+	if _, err := structure.ForWeights(ArrayOfSize(5, 1.0)); err == nil || err.(*InputError).Field != "Wts" {
+		t.Errorf("expected an error on Wts, got %v", err)
+	}
+	if _, err := structure.SNForWeights(ArrayOfSize(mustWeightsCount(t, structure), 1.0)); err == nil {
+		t.Errorf("expected an error for a single layer network with two hidden layers")
+	}
+
+	w0 := ArrayOfSize(mustWeightsCount(t, structure), 1.0)
+	if _, err := FitByCG(context.Background(), structure.ForWeights, XSample{{1, 1}, {1, 2}}, YSample{{1, 2, 3}}, nil, w0, FitOptions{ErfTol: 1e-12, MaxIter: 10}, nil); err == nil {
+		t.Errorf("expected an error for samples of different size")
+	}
+}
+
+func TestValidationReportsEveryProblem(t *testing.T) {
+	err := (&NNOrder{D: 0, M: []int{4, 0}, K: 3}).Validate()
+	if errs, ok := err.(InputErrors); !ok || len(errs) != 2 || errs[1].Field != "Order.M" || errs[1].Row != 1 {
+		t.Errorf("expected errors on Order.D and Order.M[1], got %v", err)
+	}
+
+	structure := mustStructure(t, NNOrder{D: 2, M: []int{3}, K: 1}, Regression)
+	err = structure.ValidateSample(XSample{{1, math.NaN()}, {1}}, YSample{{1, 2}})
+	expected := "X[0][1]: value is not finite: NaN; X[1]: row has 1 values instead of 2; " +
+		"T: sample sizes of X and T differ: 2 != 1; T[0]: row has 2 values instead of 1"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+	if err := structure.ValidateSample(XSample{{1, 2}}, nil); err != nil {
+		t.Errorf("expected X alone to be valid, got %v", err)
+	}
+
+	err = structure.ValidateWeights(WeightVector{1, math.Inf(1)})
+	if errs, ok := err.(InputErrors); !ok || len(errs) != 2 || errs[1].Row != 1 {
+		t.Errorf("expected errors on the length and Wts[1], got %v", err)
+	}
+}
+
+func TestFitReportsProgress(t *testing.T) {
+	structure := mustStructure(t, NNOrder{D: 2, M: []int{3, 2}, K: 3}, Regression)
+	w0 := ArrayOfSize(mustWeightsCount(t, structure), 1.0)
+
+	var reports []FitProgress
+	_, err := FitByCG(context.Background(), structure.ForWeights, XSample{{1, 1}, {1, 2}, {2, 1}}, YSample{{1, 2, 3}, {3, 2, 3}, {3, 2, 1}}, nil, w0, FitOptions{ErfTol: 1e-12, MaxIter: 50}, func(p FitProgress) {
+		reports = append(reports, p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reports) != 50 {
+		t.Fatalf("expected a report for every iteration, got %d", len(reports))
+	}
+	for i, p := range reports {
+		if p.Iteration != i+1 || p.Eta <= 0 || p.GradientNorm <= 0 {
+			t.Errorf("unexpected report %d: %+v", i, p)
+		}
+		if i > 0 && (p.ErfValue > reports[i-1].ErfValue || p.Elapsed < reports[i-1].Elapsed) {
+			t.Errorf("expected decreasing error and increasing time: %+v after %+v", p, reports[i-1])
+		}
+	}
+}
+
+func TestCancelledFitReturnsBestNetworkSoFar(t *testing.T) {
+	structure := mustStructure(t, NNOrder{D: 2, M: []int{3, 2}, K: 3}, Regression)
+	w0 := ArrayOfSize(mustWeightsCount(t, structure), 1.0)
+	sample_x := XSample{{1, 1}, {1, 2}, {2, 1}}
+	sample_t := YSample{{1, 2, 3}, {3, 2, 3}, {3, 2, 1}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var last FitProgress
+	nn, err := FitByCG(ctx, structure.ForWeights, sample_x, sample_t, nil, w0, FitOptions{ErfTol: 1e-12, MaxIter: 1000}, func(p FitProgress) {
+		last = p
+		if p.Iteration == 20 {
+			cancel()
+		}
+	})
+
+	if err != context.Canceled {
+		t.Fatalf("expected the fit to be cancelled, got %v", err)
+	}
+	if last.Iteration != 20 {
+		t.Errorf("expected no iterations after cancelling, got %d", last.Iteration)
+	}
+	if !floats.EqualWithinRel(ErfSampleValue(nn, sample_x, sample_t), last.ErfValue, 1e-12) {
+		t.Errorf("expected the weights of the last iteration: %f != %f", ErfSampleValue(nn, sample_x, sample_t), last.ErfValue)
+	}
+}
+
+func TestFitIsCancelledDuringLineSearch(t *testing.T) {
+	structure := mustStructure(t, NNOrder{D: 2, M: []int{3, 2}, K: 3}, Regression)
+	w0 := ArrayOfSize(mustWeightsCount(t, structure), 1.0)
+	sample_x := XSample{{1, 1}, {1, 2}, {2, 1}}
+	sample_t := YSample{{1, 2, 3}, {3, 2, 3}, {3, 2, 1}}
+
+	// the first call checks w0, the next two are the network and the first step of the line search
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	networkFor := func(w WeightVector) (NeuralNetwork, error) {
+		if calls++; calls == 3 {
+			cancel()
+		}
+		return structure.ForWeights(w)
+	}
+	nn, err := FitByCG(ctx, networkFor, sample_x, sample_t, nil, w0, FitOptions{}, nil)
+
+	if err != context.Canceled {
+		t.Fatalf("expected the fit to be cancelled, got %v", err)
+	}
+	if calls != 4 {
+		t.Errorf("expected the line search to stop at its next step, got %d networks", calls)
+	}
+	if !floats.Equal(nn.PackedWts(), w0) {
+		t.Errorf("expected the initial weights, got %v", nn.PackedWts())
+	}
+}
+
+func TestFitOptionsResolveToDefaults(t *testing.T) {
+	options, err := FitOptions{MaxIter: 5}.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := DefaultFitOptions
+	expected.MaxIter = 5
+	if options != expected {
+		t.Errorf("expected %+v, got %+v", expected, options)
+	}
+
+	for _, invalid := range []FitOptions{{ErfTol: -1}, {MaxIter: -1}, {TimeBudget: -time.Second}, {InitialEta: -0.5}, {LineSearchSteps: -2}} {
+		if _, err := invalid.Resolve(); err == nil {
+			t.Errorf("expected %+v to be refused", invalid)
+		}
+	}
+}
+
+func TestFitStopsWhenTimeBudgetIsUsedUp(t *testing.T) {
+	structure := mustStructure(t, NNOrder{D: 2, M: []int{30, 30}, K: 3}, Regression)
+	w0 := ArrayOfSize(mustWeightsCount(t, structure), 0.1)
+
+	start := time.Now()
+	_, err := FitByCG(context.Background(), structure.ForWeights, XSample{{1, 1}, {1, 2}, {2, 1}}, YSample{{1, 2, 3}, {3, 2, 3}, {3, 2, 1}}, nil, w0, FitOptions{ErfTol: 1e-300, MaxIter: 1000000, TimeBudget: 50 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the fit to stop after its time budget, took %v", elapsed)
+	}
+}
+
+func TestFitStopsWhenTimeBudgetIsUsedUpDuringLineSearch(t *testing.T) {
+	structure := mustStructure(t, NNOrder{D: 2, M: []int{3, 2}, K: 3}, Regression)
+	w0 := ArrayOfSize(mustWeightsCount(t, structure), 1.0)
+
+	// the first call checks w0, the next two are the network and the first step of the line search
+	calls := 0
+	networkFor := func(w WeightVector) (NeuralNetwork, error) {
+		if calls++; calls == 3 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return structure.ForWeights(w)
+	}
+	nn, err := FitByCG(context.Background(), networkFor, XSample{{1, 1}, {1, 2}, {2, 1}}, YSample{{1, 2, 3}, {3, 2, 3}, {3, 2, 1}}, nil, w0, FitOptions{TimeBudget: 10 * time.Millisecond}, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 4 {
+		t.Errorf("expected the line search to stop at its next step, got %d networks", calls)
+	}
+	if !floats.Equal(nn.PackedWts(), w0) {
+		t.Errorf("expected the initial weights, got %v", nn.PackedWts())
+	}
+}
+
+func mustStructure(t *testing.T, order NNOrder, responseType NetworkResponseType) *NNStructure {
+	structure, err := order.OfResponseType(responseType)
+	if err != nil {
+		t.Fatalf("can't create structure: %v", err)
+	}
+	return structure
+}
+
+// expectGradientsEqualApproximation runs RunTestForNNGradients with random weights on the networks of structure:
+// the multilayer one, and the single layer one too if there is a single hidden layer. It returns the weights.
+func expectGradientsEqualApproximation(t *testing.T, structure *NNStructure, rnd *rand.Rand, single_x XVector, single_t YVector) WeightVector {
+	w0 := randomWeights(t, structure, rnd)
+	RunTestForNNGradients(t, structure.ForWeights, w0, single_x, single_t)
+	if len(structure.M) == 1 && len(structure.Convolutions) == 0 && structure.Recurrent == nil {
+		RunTestForNNGradients(t, structure.SNForWeights, w0, single_x, single_t)
+	}
+	return w0
+}
+
+func mustWeightsCount(t *testing.T, structure *NNStructure) int {
+	count, err := structure.ExpectedPackedWeightsCount()
+	if err != nil {
+		t.Fatalf("can't count weights: %v", err)
+	}
+	return count
+}
+
+func mustNetwork(t *testing.T, builderFun func(WeightVector) (NeuralNetwork, error), w WeightVector) NeuralNetwork {
+	nn, err := builderFun(w)
+	if err != nil {
+		t.Fatalf("can't create network: %v", err)
+	}
+	return nn
+}
+
+func mustFit(t *testing.T, builderFun func(WeightVector) (NeuralNetwork, error), sample_x XSample, sample_t YSample, w0 WeightVector, maxIter int) NeuralNetwork {
+	nn, err := FitByCG(context.Background(), builderFun, sample_x, sample_t, nil, w0, FitOptions{ErfTol: 1e-12, MaxIter: maxIter}, nil)
+	if err != nil {
+		t.Fatalf("can't fit network: %v", err)
+	}
+	return nn
+}
+
 func fillRandom(n int) []float64 {
 	w0 := make([]float64, n)
 	for i := range w0 {
@@ -115,6 +961,15 @@ func fillRandom(n int) []float64 {
 	return w0
 }
 
+// randomWeights draws weights for structure from rnd, between -0.5 and 0.5.
+func randomWeights(t *testing.T, structure *NNStructure, rnd *rand.Rand) WeightVector {
+	w0 := make(WeightVector, mustWeightsCount(t, structure))
+	for i := range w0 {
+		w0[i] = rnd.Float64() - 0.5
+	}
+	return w0
+}
+
 func expectTemplateNetwork(t *testing.T, nn NeuralNetwork, best_nn NeuralNetwork, sample_x XSample, sample_t YSample) {
 	ExpectNN(
 		t, sample_x, sample_t, nn,
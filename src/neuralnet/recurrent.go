@@ -0,0 +1,219 @@
+package neuralnet
+
+import "fmt"
+
+// RecurrentLayer feeds the first hidden layer its own outputs of the previous step of a sequence, as in Elman
+// networks. The rows of X then hold sequences, step after step, of D inputs each.
+type RecurrentLayer struct {
+	// EveryStep predicts the K targets at every step of a sequence, one step after the other, instead of at the
+	// last step only.
+	EveryStep bool `json:",omitempty"`
+	// Truncate limits backpropagation through time to blocks of that many steps, if positive. The outputs are
+	// still carried forward over the whole sequence.
+	Truncate int `json:",omitempty"`
+}
+
+// XSequences hold a sequence of inputs for every sample, YSequences a sequence of targets.
+type XSequences []XSample
+type YSequences []YSample
+
+// Flatten lays every sequence out in a single row, step after step, as recurrent networks take them.
+func (sequences XSequences) Flatten() XSample {
+	rows := make(XSample, len(sequences))
+	for i, sequence := range sequences {
+		rows[i] = XVector{}
+		for _, step := range sequence {
+			rows[i] = append(rows[i], step...)
+		}
+	}
+	return rows
+}
+
+func (sequences YSequences) Flatten() YSample {
+	rows := make(YSample, len(sequences))
+	for i, sequence := range sequences {
+		rows[i] = YVector{}
+		for _, step := range sequence {
+			rows[i] = append(rows[i], step...)
+		}
+	}
+	return rows
+}
+
+// recurrentWeightsCount counts the weights from the first hidden layer back into itself, which follow all others
+// but the parameters of the error function. The weight from unit i to unit j is at i + j*M[0].
+func (order *NNOrder) recurrentWeightsCount() int {
+	if order.Recurrent == nil || len(order.M) == 0 {
+		return 0
+	}
+	return order.M[0] * order.M[0]
+}
+
+// validateSequences checks that the rows of x are whole sequences, and that the ones of t have targets for the
+// last or every step of them.
+func (structure *NNStructure) validateSequences(x XSample, t YSample) InputErrors {
+	var errs InputErrors
+	for i, row := range x {
+		if len(row) == 0 || len(row)%structure.D != 0 {
+			errs = append(errs, inputErrorAt("X", i, -1, "a sequence needs steps of %d inputs, got %d values", structure.D, len(row)))
+			continue
+		}
+		if i >= len(t) {
+			continue
+		}
+		width := structure.K
+		if structure.Recurrent.EveryStep {
+			width *= len(row) / structure.D
+		}
+		if len(t[i]) != width {
+			errs = append(errs, inputErrorAt("T", i, -1, "row has %d values instead of %d", len(t[i]), width))
+		}
+	}
+	return errs
+}
+
+type RecurrentNN struct {
+	*MultiLayerNN
+}
+
+// rec_idx is the index of the weight from unit i of the first hidden layer at the previous step to unit j.
+func (nn *MultiLayerNN) rec_idx(j int, i int) int {
+	return nn.recurrentOffset + i + j*nn.L[1]
+}
+
+// addRecurrent adds what the outputs of the first hidden layer at the previous step contribute to its activations a.
+func (nn *MultiLayerNN) addRecurrent(previous []float64, a []float64) {
+	for j := range a {
+		for i, zi := range previous {
+			a[j] += nn.wts[nn.rec_idx(j, i)] * zi
+		}
+	}
+}
+
+// recurrentStep holds the activations and outputs of all layers at a step of a sequence.
+type recurrentStep struct {
+	convA [][]float64
+	convZ [][]float64
+	a     [][]float64
+	z     [][]float64
+	a_k   []float64
+	y     YVector
+}
+
+func (nn *RecurrentNN) run(x XVector) []recurrentStep {
+	if len(x) == 0 || len(x)%nn.structure.D != 0 {
+		panic(fmt.Sprintf("invalid length of sequence: %d is no multiple of %d", len(x), nn.structure.D))
+	}
+	steps := make([]recurrentStep, len(x)/nn.structure.D)
+	var previous []float64
+	for s := range steps {
+		step := &steps[s]
+		step.convA, step.convZ = nn.convolve(x[s*nn.structure.D : (s+1)*nn.structure.D])
+		step.a, step.z = nn.fwdPropDense(step.convZ[len(step.convZ)-1], previous)
+		step.a_k = nn.a_k(step.z)
+		step.y = nn.structure.Sigma(step.a_k)
+		previous = step.z[1]
+	}
+	return steps
+}
+
+// predicted lists the steps with outputs: all of them, or the last one.
+func (nn *RecurrentNN) predicted(steps []recurrentStep) []int {
+	if nn.structure.Recurrent.EveryStep {
+		all := make([]int, len(steps))
+		for s := range all {
+			all[s] = s
+		}
+		return all
+	}
+	return []int{len(steps) - 1}
+}
+
+// Predict returns the outputs of the last step, or of every step one after another.
+func (nn *RecurrentNN) Predict(x XVector) YVector {
+	steps := nn.run(x)
+	var y YVector
+	for _, s := range nn.predicted(steps) {
+		y = append(y, steps[s].y...)
+	}
+	return y
+}
+
+// Hidden lists the outputs of the convolutions and the hidden layers at the steps with outputs.
+func (nn *RecurrentNN) Hidden(x XVector) []float64 {
+	steps := nn.run(x)
+	var z_flat []float64
+	for _, s := range nn.predicted(steps) {
+		for _, zv := range append(steps[s].convZ[1:], steps[s].z[1:]...) {
+			z_flat = append(z_flat, zv...)
+		}
+	}
+	return z_flat
+}
+
+// targets returns the targets of step s of the sequence, or nil if the step has none.
+func (nn *RecurrentNN) targets(t YVector, s int, steps int) YVector {
+	K := nn.structure.K
+	switch {
+	case nn.structure.Recurrent.EveryStep:
+		if len(t) != steps*K {
+			panic(fmt.Sprintf("invalid length of t: %d != %d", len(t), steps*K))
+		}
+		return t[s*K : (s+1)*K]
+	case len(t) != K:
+		panic(fmt.Sprintf("invalid length of t: %d != %d", len(t), K))
+	case s == steps-1:
+		return t
+	default:
+		return nil
+	}
+}
+
+func (nn *RecurrentNN) ErfValue(x XVector, t YVector) float64 {
+	steps := nn.run(x)
+	erf := 0.0
+	for s, step := range steps {
+		if t_s := nn.targets(t, s, len(steps)); t_s != nil {
+			erf += nn.structure.errorValue(step.y, t_s, nn.wts)
+		}
+	}
+	return erf
+}
+
+// Gradient backpropagates through time, from the last step to the first, unless Truncate cuts the sequence
+// into blocks.
+func (nn *RecurrentNN) Gradient(x XVector, t YVector) WeightVector {
+	gradient := make([]float64, nn.count)
+	steps := nn.run(x)
+
+	var carry []float64
+	for s := len(steps) - 1; s >= 0; s-- {
+		if truncate := nn.structure.Recurrent.Truncate; truncate > 0 && (s+1)%truncate == 0 {
+			carry = nil
+		}
+		step := steps[s]
+		delta_k := make([]float64, nn.structure.outputs())
+		if t_s := nn.targets(t, s, len(steps)); t_s != nil {
+			delta_k = nn.structure.outputDelta(step.a_k, step.y, t_s, nn.wts)
+			nn.structure.paramsGradient(gradient, step.y, t_s, nn.wts)
+		}
+
+		delta_j := nn.backprop(gradient, step.a, step.z, delta_k, carry)
+		if len(nn.structure.Convolutions) != 0 {
+			nn.backpropConvolutions(step.convA, step.convZ, nn.backpropLayer(0, delta_j), gradient)
+		}
+
+		carry = make([]float64, nn.L[1])
+		for j, dj := range delta_j[1] {
+			for i := range carry {
+				carry[i] += nn.wts[nn.rec_idx(j, i)] * dj
+				if s > 0 {
+					gradient[nn.rec_idx(j, i)] += dj * steps[s-1].z[1][i]
+				}
+			}
+		}
+	}
+	nn.structure.Ties.sum(gradient)
+	nn.structure.Mask.fix(gradient)
+	return gradient
+}
@@ -15,7 +15,7 @@ func (nn *SingleLayerNN) PackedWts() []float64 {
 }
 
 func (nn *SingleLayerNN) ExpectedPackedWeightsCount() int {
-	return nn.structure.ExpectedPackedWeightsCount()
+	return nn.structure.packedWeightsCount()
 }
 
 func (nn *SingleLayerNN) dm(d int, m int) int {
@@ -26,10 +26,33 @@ func (nn *SingleLayerNN) dm(d int, m int) int {
 }
 
 func (nn *SingleLayerNN) mk(m int, k int) int {
-	if !(m < nn.structure.M[0] && k < nn.structure.K) {
+	if !(m < nn.structure.M[0] && k < nn.structure.outputs()) {
 		panic(fmt.Sprintf("invalid indexes %d %d", m, k))
 	}
-	return nn.structure.M[0]*nn.structure.D + m + k*nn.structure.M[0]
+	return nn.structure.M[0]*nn.structure.D + nn.structure.biasCount(nn.structure.M[0]) + m + k*nn.structure.M[0]
+}
+
+// mBias and kBias are the indexes of the biases of the hidden and output units, when the network has them.
+func (nn *SingleLayerNN) mBias(m int) int {
+	if nn.structure.NoBias || m >= nn.structure.M[0] {
+		panic(fmt.Sprintf("invalid bias index %d", m))
+	}
+	return nn.structure.M[0]*nn.structure.D + m
+}
+
+func (nn *SingleLayerNN) kBias(k int) int {
+	if nn.structure.NoBias || k >= nn.structure.outputs() {
+		panic(fmt.Sprintf("invalid bias index %d", k))
+	}
+	return nn.structure.M[0]*(nn.structure.D+1+nn.structure.outputs()) + k
+}
+
+// dk is the index of the weight of the skip from input d to output k, when the network has one.
+func (nn *SingleLayerNN) dk(d int, k int) int {
+	if len(nn.structure.Skips) == 0 || !(d < nn.structure.D && k < nn.structure.outputs()) {
+		panic(fmt.Sprintf("invalid skip indexes %d %d", d, k))
+	}
+	return nn.structure.layerWeightsCount(nn.structure.outputs()) + d + k*nn.structure.D
 }
 
 func (nn *SingleLayerNN) a_j(x XVector) []float64 {
@@ -38,6 +61,9 @@ func (nn *SingleLayerNN) a_j(x XVector) []float64 {
 	}
 	a_j := make([]float64, nn.structure.M[0])
 	for m := range a_j {
+		if !nn.structure.NoBias {
+			a_j[m] = nn.wts[nn.mBias(m)]
+		}
 		for d, xv := range x {
 			a_j[m] += nn.wts[nn.dm(d, m)] * xv
 		}
@@ -54,21 +80,29 @@ func mapOverVector(vs []float64, f func(float64) float64) []float64 {
 }
 
 func (nn *SingleLayerNN) z_j(a_j []float64) []float64 {
-	return mapOverVector(a_j, nn.structure.H)
+	return mapOverVector(a_j, nn.structure.H[0])
 }
 
-func (nn *SingleLayerNN) a_k(z_j []float64) []float64 {
-	a_k := make([]float64, nn.structure.K)
+func (nn *SingleLayerNN) a_k(x XVector, z_j []float64) []float64 {
+	a_k := make([]float64, nn.structure.outputs())
 	for k := range a_k {
+		if !nn.structure.NoBias {
+			a_k[k] = nn.wts[nn.kBias(k)]
+		}
 		for m := range z_j {
 			a_k[k] += nn.wts[nn.mk(m, k)] * (z_j)[m]
 		}
+		if len(nn.structure.Skips) > 0 {
+			for d, xv := range x {
+				a_k[k] += nn.wts[nn.dk(d, k)] * xv
+			}
+		}
 	}
 	return a_k
 }
 
 func (nn *SingleLayerNN) z_k(a_k []float64) []float64 {
-	return mapOverVector(a_k, nn.structure.Sigma)
+	return nn.structure.Sigma(a_k)
 }
 
 func (nn *SingleLayerNN) Hidden(x XVector) []float64 {
@@ -78,7 +112,7 @@ func (nn *SingleLayerNN) Hidden(x XVector) []float64 {
 func (nn *SingleLayerNN) Predict(x XVector) YVector {
 	a_j := nn.a_j(x)
 	z_j := nn.z_j(a_j)
-	a_k := nn.a_k(z_j)
+	a_k := nn.a_k(x, z_j)
 	y_k := nn.z_k(a_k)
 	return y_k
 }
@@ -88,43 +122,54 @@ func (nn *SingleLayerNN) ErfValue(x XVector, t YVector) float64 {
 		panic(fmt.Sprintf("invalid length of t: %d != %d", len(t), nn.structure.K))
 	}
 
-	return nn.structure.ErrorFunction(nn.Predict(x), t)
+	return nn.structure.errorValue(nn.Predict(x), t, nn.wts)
 }
 
 func (nn *SingleLayerNN) Gradient(x XVector, t YVector) WeightVector {
-	gradient := make([]float64, nn.structure.ExpectedPackedWeightsCount())
+	gradient := make([]float64, nn.structure.packedWeightsCount())
 
 	// forward...
 	a_j := nn.a_j(x)
 	z_j := nn.z_j(a_j)
-	a_k := nn.a_k(z_j)
+	a_k := nn.a_k(x, z_j)
 	y := nn.z_k(a_k)
 
-	delta_k := make([]float64, nn.structure.K)
-	for k := range delta_k {
-		delta_k[k] = y[k] - t[k] // Assuming canonical link function is used...
-	}
+	delta_k := nn.structure.outputDelta(a_k, y, t, nn.wts)
 
 	delta_j := make([]float64, nn.structure.M[0])
 	for j := range delta_j {
 		for k := range delta_k {
 			delta_j[j] += nn.wts[nn.mk(j, k)] * delta_k[k]
 		}
-		delta_j[j] *= nn.structure.H_prim(a_j[j])
+		delta_j[j] *= nn.structure.H_prim[0](a_j[j])
 	}
 
 	for j, dj := range delta_j {
 		for i, xi := range x {
 			gradient[nn.dm(i, j)] = dj * xi
 		}
+		if !nn.structure.NoBias {
+			gradient[nn.mBias(j)] = dj
+		}
 	}
 
 	for k, dk := range delta_k {
 		for j, zj := range z_j {
 			gradient[nn.mk(j, k)] = dk * zj
 		}
+		if !nn.structure.NoBias {
+			gradient[nn.kBias(k)] = dk
+		}
+		if len(nn.structure.Skips) > 0 {
+			for i, xi := range x {
+				gradient[nn.dk(i, k)] = dk * xi
+			}
+		}
 	}
 
+	nn.structure.paramsGradient(gradient, y, t, nn.wts)
+	nn.structure.Ties.sum(gradient)
+	nn.structure.Mask.fix(gradient)
 	return gradient
 }
 
@@ -151,3 +196,32 @@ func crossentropy(y YVector, t YVector) float64 {
 	}
 	return result
 }
+
+// categoricalCrossentropy expects t to be a one-hot vector, or class probabilities.
+func categoricalCrossentropy(y YVector, t YVector) float64 {
+	result := 0.0
+	for i := range t {
+		if t[i] != 0 {
+			result -= t[i] * math.Log(y[i])
+		}
+	}
+	return result
+}
+
+func crossentropyDerivative(y YVector, t YVector) []float64 {
+	dE_dy := make([]float64, len(y))
+	for k := range dE_dy {
+		dE_dy[k] = (y[k] - t[k]) / (y[k] * (1 - y[k]))
+	}
+	return dE_dy
+}
+
+func categoricalCrossentropyDerivative(y YVector, t YVector) []float64 {
+	dE_dy := make([]float64, len(y))
+	for k := range dE_dy {
+		if t[k] != 0 {
+			dE_dy[k] = -t[k] / y[k]
+		}
+	}
+	return dE_dy
+}
@@ -1,9 +1,12 @@
 package neuralnet
 
 import (
+	"context"
 	"fmt"
+	"gonum.org/v1/gonum/floats"
 	"math"
 	"os"
+	"time"
 )
 
 type WeightVector []float64
@@ -16,14 +19,71 @@ type NNOrder struct {
 	D int
 	M []int
 	K int
+	// Activations of the hidden layers, one per layer of M. All of them are tanh if left out.
+	Activations []Activation `json:",omitempty"`
+	// NoBias leaves out the bias weights of the hidden and output units, as weight vectors of older versions did.
+	NoBias bool `json:",omitempty"`
+	// Skips connect layers past the next one, e.g. the inputs straight to the outputs.
+	Skips []Skip `json:",omitempty"`
+	// InputChannels splits the D inputs into channels of sequences for Convolutions, 1 if left out.
+	InputChannels int `json:",omitempty"`
+	// Convolutions run over the inputs one after another, ahead of the dense layers of M.
+	Convolutions []ConvLayer `json:",omitempty"`
+	// Recurrent makes the first hidden layer recurrent, for sequences of inputs.
+	Recurrent *RecurrentLayer `json:",omitempty"`
+}
+
+// Skip connects every unit of layer From to every unit of layer To, where layer 0 is the input, or the output of
+// the last convolution, 1 to len(M) the hidden layers and len(M)+1 the output. The weights of all skips follow the
+// ones of the layers, skip after skip, with the weight from unit i to unit j at i + j*size of From. Skips have no
+// biases of their own.
+type Skip struct {
+	From int
+	To   int
 }
 
 type NNStructure struct {
 	NNOrder
-	H             func(float64) float64
-	H_prim        func(float64) float64
-	Sigma         func(float64) float64
+	// H and H_prim hold the activation of every hidden layer and its derivative.
+	H      []func(float64) float64
+	H_prim []func(float64) float64
+	// Sigma maps the activations of the output units to the predictions.
+	Sigma func([]float64) YVector
+	// SigmaPrim is the Jacobian of Sigma, dy[k]/da[j] in row k and column j.
+	SigmaPrim     func([]float64) [][]float64
 	ErrorFunction func(YVector, YVector) float64
+	// ErrorDerivative is the derivative of ErrorFunction by the predictions y.
+	ErrorDerivative func(y YVector, t YVector) []float64
+	// Canonical pairings of Sigma and ErrorFunction backpropagate y - t, without applying the derivatives.
+	// Either derivative left nil is approximated numerically.
+	Canonical    bool
+	ResponseType NetworkResponseType
+	// Outputs is the number of output units, K unless the response type predicts more than a value per target.
+	// Left out, it is K.
+	Outputs int
+	// ObservedOutputs lists the outputs that predict the given targets, for leaving out the ones of missing
+	// targets. If nil, output k predicts target k.
+	ObservedOutputs func(targets []int) []int
+	// MomentsOf splits the outputs into the predicted means and standard deviations of the targets. If nil,
+	// the outputs are the means and there are no standard deviations.
+	MomentsOf func(y YVector) (mean YVector, stddev YVector)
+	// ResponseParams are the ones the error function was made with, defaults included.
+	ResponseParams ResponseParams
+	// Params replace ErrorFunction for error functions with fitted parameters, nil otherwise.
+	Params *LossParams
+	// Mask freezes or prunes some of the weights, if not nil. The networks read absent weights as 0 and report
+	// no gradient by the weights that aren't trainable.
+	Mask WeightMask
+	// Ties share a parameter between the weights of each group, if not nil.
+	Ties WeightTies
+}
+
+// outputs is the number of output units, which structures built by hand may leave to default to K.
+func (structure *NNStructure) outputs() int {
+	if structure.Outputs == 0 {
+		return structure.K
+	}
+	return structure.Outputs
 }
 
 type NetworkResponseType string
@@ -31,6 +91,19 @@ type NetworkResponseType string
 const (
 	Regression       NetworkResponseType = "regression"
 	BinaryClassifier NetworkResponseType = "binary"
+	// MulticlassClassifier predicts the probabilities of K mutually exclusive classes.
+	MulticlassClassifier NetworkResponseType = "multiclass"
+	// Poisson and NegativeBinomial predict the means of counts, through exp outputs.
+	Poisson          NetworkResponseType = "poisson"
+	NegativeBinomial NetworkResponseType = "negative_binomial"
+	// Gaussian predicts the mean and the variance of every target, from 2*K outputs.
+	Gaussian NetworkResponseType = "gaussian"
+	// MixtureDensity predicts a mixture of normal distributions over the targets, see Mixture.
+	MixtureDensity NetworkResponseType = "mixture"
+	// Huber, Absolute and Quantile are regressions with losses less sensitive to outliers than squared error.
+	Huber    NetworkResponseType = "huber"
+	Absolute NetworkResponseType = "absolute"
+	Quantile NetworkResponseType = "quantile"
 )
 
 func sigmoid(x float64) float64 {
@@ -46,99 +119,465 @@ func sigmoidDerivative(x float64) float64 {
 	return sx * (1 - sx)
 }
 
-func (order NNOrder) OfResponseType(responseType NetworkResponseType) *NNStructure {
+func (order NNOrder) OfResponseType(responseType NetworkResponseType) (*NNStructure, error) {
+	return order.OfResponse(responseType, ResponseParams{})
+}
+
+// OfResponse is OfResponseType with the parameters of the error functions that have any.
+func (order NNOrder) OfResponse(responseType NetworkResponseType, params ResponseParams) (*NNStructure, error) {
+	if err := order.Validate(); err != nil {
+		return nil, err
+	}
+	params, err := params.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	h := make([]func(float64) float64, len(order.M))
+	h_prim := make([]func(float64) float64, len(order.M))
+	for l := range order.M {
+		activation := activationFunctions[order.activationOf(l)]
+		h[l], h_prim[l] = activation.h, activation.h_prim
+	}
+
+	structure := &NNStructure{NNOrder: order, H: h, H_prim: h_prim, ResponseType: responseType, Outputs: order.K, ResponseParams: params}
 	switch responseType {
 	case Regression:
-		return &NNStructure{order, math.Tanh, tanhDerivative, func(x float64) float64 { return x }, func(y YVector, t YVector) float64 { return ssqdiff(y, t) / 2 }}
+		structure.Sigma, structure.SigmaPrim = elementwise(identity), elementwisePrim(one)
+		structure.ErrorFunction = func(y YVector, t YVector) float64 { return ssqdiff(y, t) / 2 }
+		structure.ErrorDerivative, structure.Canonical = residuals, true
 	case BinaryClassifier:
-		return &NNStructure{order, math.Tanh, tanhDerivative, sigmoid, crossentropy}
+		structure.Sigma, structure.SigmaPrim = elementwise(sigmoid), elementwisePrim(sigmoidDerivative)
+		structure.ErrorFunction, structure.ErrorDerivative, structure.Canonical = crossentropy, crossentropyDerivative, true
+	case MulticlassClassifier:
+		if order.K < 2 {
+			return nil, inputErrorf("Order.K", "a multiclass network needs at least 2 classes, got %d", order.K)
+		}
+		structure.Sigma, structure.SigmaPrim = softmax, softmaxPrim
+		structure.ErrorFunction, structure.ErrorDerivative, structure.Canonical = categoricalCrossentropy, categoricalCrossentropyDerivative, true
+	case Poisson:
+		structure.Sigma, structure.SigmaPrim = elementwise(math.Exp), elementwisePrim(math.Exp)
+		structure.ErrorFunction, structure.ErrorDerivative, structure.Canonical = poissonDeviance, poissonDevianceDerivative, true
+	case NegativeBinomial:
+		structure.Sigma, structure.SigmaPrim = elementwise(math.Exp), elementwisePrim(math.Exp)
+		structure.Params = negativeBinomial
+	case Gaussian:
+		structure.Outputs = 2 * order.K
+		structure.Sigma, structure.SigmaPrim = elementwise(identity), elementwisePrim(one)
+		structure.ErrorFunction, structure.ErrorDerivative = gaussianNLL, gaussianNLLDerivative
+		structure.ObservedOutputs = gaussianOutputs(order.K)
+		structure.MomentsOf = gaussianMoments
+	case MixtureDensity:
+		C := params.Components
+		structure.Outputs = C * (order.K + 2)
+		structure.Sigma, structure.SigmaPrim = mixtureSigma(C), mixtureSigmaPrim(C)
+		structure.ErrorFunction, structure.ErrorDerivative = mixtureNLL(C), mixtureNLLDerivative(C)
+		structure.ObservedOutputs = mixtureOutputs(C, order.K)
+		structure.MomentsOf = mixtureMoments(C)
+	case Huber:
+		structure.Sigma, structure.SigmaPrim = elementwise(identity), elementwisePrim(one)
+		structure.ErrorFunction, structure.ErrorDerivative = huberLoss(params.HuberDelta)
+	case Absolute:
+		structure.Sigma, structure.SigmaPrim = elementwise(identity), elementwisePrim(one)
+		structure.ErrorFunction, structure.ErrorDerivative = absoluteLoss, absoluteLossDerivative
+	case Quantile:
+		structure.Sigma, structure.SigmaPrim = elementwise(identity), elementwisePrim(one)
+		structure.ErrorFunction, structure.ErrorDerivative = pinballLoss(params.Quantile)
 	default:
-		panic(fmt.Sprintf("unknown response type %s", responseType))
+		return nil, inputErrorf("NetworkRT", "unknown response type %q", responseType)
 	}
+	if order.Recurrent != nil && order.Recurrent.EveryStep && structure.MomentsOf != nil {
+		return nil, inputErrorf("Order.Recurrent.EveryStep", "%s networks can only predict the last step", responseType)
+	}
+	return structure, nil
 }
 
-func (order *NNOrder) ExpectedPackedWeightsCount() int {
+// Validate reports every problem with the order as InputErrors.
+func (order *NNOrder) Validate() error {
+	var errs InputErrors
+	if order.D <= 0 {
+		errs = append(errs, inputErrorAt("Order.D", -1, -1, "input dimension must be positive, got %d", order.D))
+	}
 	if len(order.M) == 0 {
-		panic("no hidden layers given - M = 0")
+		errs = append(errs, inputErrorAt("Order.M", -1, -1, "no hidden layers given - M = 0"))
 	}
-	hiddenLayerWeights := order.M[0] * order.D
-	for i := 1; i < len(order.M); i++ {
-		hiddenLayerWeights += order.M[i-1] * order.M[i]
+	for l, m := range order.M {
+		if m <= 0 {
+			errs = append(errs, inputErrorAt("Order.M", l, -1, "hidden layer %d must have a positive size, got %d", l, m))
+		}
 	}
-	return hiddenLayerWeights + order.M[len(order.M)-1]*order.K
+	if len(order.Activations) != 0 && len(order.Activations) != len(order.M) {
+		errs = append(errs, inputErrorAt("Order.Activations", -1, -1, "expected an activation for each of the %d hidden layers, got %d", len(order.M), len(order.Activations)))
+	}
+	for l, activation := range order.Activations {
+		if _, ok := activationFunctions[activation]; !ok {
+			errs = append(errs, inputErrorAt("Order.Activations", l, -1, "unknown activation %q", activation))
+		}
+	}
+	if order.K <= 0 {
+		errs = append(errs, inputErrorAt("Order.K", -1, -1, "output dimension must be positive, got %d", order.K))
+	}
+	errs = append(errs, order.validateConvolutions()...)
+	if order.Recurrent != nil && order.Recurrent.Truncate < 0 {
+		errs = append(errs, inputErrorAt("Order.Recurrent.Truncate", -1, -1, "truncation can't be negative, got %d", order.Recurrent.Truncate))
+	}
+	for i, skip := range order.Skips {
+		if !(skip.From >= 0 && skip.From+1 < skip.To && skip.To <= len(order.M)+1) {
+			errs = append(errs, inputErrorAt("Order.Skips", i, -1, "a skip must lead from a layer past the next one, up to the output %d, got %d to %d", len(order.M)+1, skip.From, skip.To))
+		}
+		for _, previous := range order.Skips[:i] {
+			if previous == skip {
+				errs = append(errs, inputErrorAt("Order.Skips", i, -1, "layers %d and %d are already connected", skip.From, skip.To))
+				break
+			}
+		}
+	}
+	return errs.orNil()
 }
 
-func (structure *NNStructure) ForWeights(wts WeightVector) NeuralNetwork {
-	if len(wts) != structure.ExpectedPackedWeightsCount() {
-		panic(fmt.Sprintf("invalid length of weights %d != %d", len(wts), structure.ExpectedPackedWeightsCount()))
+func (order *NNOrder) ExpectedPackedWeightsCount() (int, error) {
+	if err := order.Validate(); err != nil {
+		return 0, err
 	}
-	return &MultiLayerNN{structure, wts, networkLayers(structure)}
+	return order.packedWeightsCount(), nil
 }
 
-func (structure *NNStructure) SNForWeights(wts WeightVector) NeuralNetwork {
-	if len(wts) != structure.ExpectedPackedWeightsCount() {
-		panic(fmt.Sprintf("invalid length of weights %d != %d", len(wts), structure.ExpectedPackedWeightsCount()))
+// packedWeightsCount assumes the order is already validated.
+func (order *NNOrder) packedWeightsCount() int {
+	return order.weightsCount(order.K)
+}
+
+// ExpectedPackedWeightsCount counts the weights of the network and the parameters of its error function.
+func (structure *NNStructure) ExpectedPackedWeightsCount() (int, error) {
+	if err := structure.Validate(); err != nil {
+		return 0, err
+	}
+	return structure.packedWeightsCount(), nil
+}
+
+func (structure *NNStructure) packedWeightsCount() int {
+	count := structure.weightsCount(structure.outputs())
+	if structure.Params != nil {
+		count += structure.Params.Count
+	}
+	return count
+}
+
+// weightsCount counts the weights of a network with that many output units.
+func (order *NNOrder) weightsCount(outputs int) int {
+	count := order.convWeightsCount() + order.layerWeightsCount(outputs)
+	sizes := order.layerSizes(outputs)
+	for _, skip := range order.Skips {
+		count += sizes[skip.From] * sizes[skip.To]
+	}
+	return count + order.recurrentWeightsCount()
+}
+
+// layerWeightsCount counts the weights between consecutive layers, which precede the ones of the skips.
+func (order *NNOrder) layerWeightsCount(outputs int) int {
+	count := 0
+	sizes := order.layerSizes(outputs)
+	for l := 1; l < len(sizes); l++ {
+		count += sizes[l-1]*sizes[l] + order.biasCount(sizes[l])
+	}
+	return count
+}
+
+// layerSizes are the numbers of units of the input of the dense layers, the hidden layers and the output.
+func (order *NNOrder) layerSizes(outputs int) []int {
+	return append(append([]int{order.denseInputs()}, order.M...), outputs)
+}
+
+// biasCount is the number of bias weights of a layer with that many units,
+// which follow the other weights into the layer.
+func (order *NNOrder) biasCount(units int) int {
+	if order.NoBias {
+		return 0
+	}
+	return units
+}
+
+func (structure *NNStructure) checkWeights(wts WeightVector) error {
+	if len(wts) != structure.packedWeightsCount() {
+		return inputErrorf("Wts", "invalid length of weights %d != %d", len(wts), structure.packedWeightsCount())
+	}
+	if structure.Mask != nil && len(structure.Mask) != len(wts) {
+		return inputErrorf("Mask", "expected a state for each of the %d weights, got %d", len(wts), len(structure.Mask))
+	}
+	if errs := structure.Ties.validate(len(wts), structure.Mask); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (structure *NNStructure) ForWeights(wts WeightVector) (NeuralNetwork, error) {
+	if err := structure.checkWeights(wts); err != nil {
+		return nil, err
+	}
+	nn := newMultiLayerNN(structure, structure.Mask.apply(structure.Ties.tie(wts)))
+	if structure.Recurrent != nil {
+		return &RecurrentNN{nn}, nil
+	}
+	return nn, nil
+}
+
+func (structure *NNStructure) SNForWeights(wts WeightVector) (NeuralNetwork, error) {
+	if err := structure.checkWeights(wts); err != nil {
+		return nil, err
 	}
 	if len(structure.M) != 1 {
-		panic(fmt.Sprintf("can't creata e single hidden layer when there are more requested: %v", structure.M))
+		return nil, inputErrorf("Order.M", "can't create a single hidden layer network when there are more requested: %v", structure.M)
+	}
+	if len(structure.Convolutions) != 0 {
+		return nil, inputErrorf("Order.Convolutions", "a single hidden layer network can't have convolutions")
 	}
-	return &SingleLayerNN{structure, wts}
+	if structure.Recurrent != nil {
+		return nil, inputErrorf("Order.Recurrent", "a single hidden layer network can't be recurrent")
+	}
+	return &SingleLayerNN{structure, structure.Mask.apply(structure.Ties.tie(wts))}, nil
 }
 
 func networkLayers(structure *NNStructure) []int {
-	L := make([]int, 2+len(structure.M))
-	L[0] = structure.D
-	copy(L[1:len(L)-1], structure.M)
-	L[len(L)-1] = structure.K
-	return L
+	return structure.layerSizes(structure.outputs())
 }
 
-func FitByCG(networkFor func(w0 WeightVector) NeuralNetwork, sampleX XSample, sampleT YSample, w0 WeightVector, verbose bool, erfTol float64, maxIter int) NeuralNetwork {
-	eta := 1.0
+// Targets returns the sample of targets the network is fitted to on the inputs x. For multiclass networks, rows of T
+// holding a single class label from 0 to K-1 are expanded into one-hot vectors, as are rows holding a label for
+// every step of their sequence when a recurrent network predicts every step. Other rows are taken as they are.
+func (structure *NNStructure) Targets(sampleX XSample, sampleT YSample) (YSample, error) {
+	if structure.ResponseType != MulticlassClassifier {
+		return sampleT, nil
+	}
+	var errs InputErrors
+	targets := make(YSample, len(sampleT))
+	for i, t := range sampleT {
+		labels := 1
+		if structure.Recurrent != nil && structure.Recurrent.EveryStep && i < len(sampleX) {
+			labels = len(sampleX[i]) / structure.D
+		}
+		if len(t) != labels || labels == 0 {
+			targets[i] = t
+			continue
+		}
+		targets[i] = make(YVector, 0, labels*structure.K)
+		for s, value := range t {
+			if math.IsNaN(value) {
+				targets[i] = append(targets[i], ArrayOfSize(structure.K, math.NaN())...)
+				continue
+			}
+			label := int(value)
+			if float64(label) != value || label < 0 || label >= structure.K {
+				errs = append(errs, inputErrorAt("T", i, s, "class label must be an integer from 0 to %d, got %g", structure.K-1, value))
+				continue
+			}
+			oneHot := make(YVector, structure.K)
+			oneHot[label] = 1
+			targets[i] = append(targets[i], oneHot...)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return targets, nil
+}
+
+// MaskTargets marks the targets that weren't observed, i.e. false in observed, as missing by setting them to NaN.
+// A nil observed leaves t as it is.
+func MaskTargets(sampleT YSample, observed [][]bool) (YSample, error) {
+	if observed == nil {
+		return sampleT, nil
+	}
+	if len(observed) != len(sampleT) {
+		return nil, inputErrorf("TMask", "expected a row for each of the %d rows of T, got %d", len(sampleT), len(observed))
+	}
+	var errs InputErrors
+	masked := make(YSample, len(sampleT))
+	for i, t := range sampleT {
+		if len(observed[i]) != len(t) {
+			errs = append(errs, inputErrorAt("TMask", i, -1, "row has %d values instead of %d", len(observed[i]), len(t)))
+			continue
+		}
+		masked[i] = append(YVector{}, t...)
+		for k, ok := range observed[i] {
+			if !ok {
+				masked[i][k] = math.NaN()
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return masked, nil
+}
+
+func CheckSampleSizes(sampleX XSample, sampleT YSample) error {
+	if len(sampleX) != len(sampleT) {
+		return inputErrorf("T", "sample sizes of X and T differ: %d != %d", len(sampleX), len(sampleT))
+	}
+	return nil
+}
+
+// FitProgress describes the state of a fit after an iteration.
+type FitProgress struct {
+	Iteration    int
+	ErfValue     float64
+	Eta          float64
+	GradientNorm float64
+	Elapsed      time.Duration
+}
+
+// FitOptions control FitByCG. Zero values stand for the defaults, see Resolve.
+type FitOptions struct {
+	ErfTol          float64       // stop when an iteration improves the error function by less
+	MaxIter         int           // stop after that many iterations
+	TimeBudget      time.Duration // stop after fitting for that long, even within a line search; no limit if 0
+	InitialEta      float64       // the step size to start the line search from
+	LineSearchSteps int           // the number of halvings or doublings of the step size in each line search
+	Verbose         bool
+}
+
+var DefaultFitOptions = FitOptions{ErfTol: 1e-12, MaxIter: 10000, InitialEta: 1, LineSearchSteps: 15}
+
+// Resolve replaces the zero values by the defaults, and checks that the rest are valid.
+func (options FitOptions) Resolve() (FitOptions, error) {
+	if options.ErfTol < 0 {
+		return options, inputErrorf("Options.ErfTol", "tolerance can't be negative, got %g", options.ErfTol)
+	}
+	if options.MaxIter < 0 {
+		return options, inputErrorf("Options.MaxIter", "iteration count can't be negative, got %d", options.MaxIter)
+	}
+	if options.TimeBudget < 0 {
+		return options, inputErrorf("Options.TimeBudget", "time budget can't be negative, got %v", options.TimeBudget)
+	}
+	if options.InitialEta < 0 || math.IsInf(options.InitialEta, 0) || math.IsNaN(options.InitialEta) {
+		return options, inputErrorf("Options.InitialEta", "initial step size must be positive, got %g", options.InitialEta)
+	}
+	if options.LineSearchSteps < 0 {
+		return options, inputErrorf("Options.LineSearchSteps", "line search steps can't be negative, got %d", options.LineSearchSteps)
+	}
+
+	if options.ErfTol == 0 {
+		options.ErfTol = DefaultFitOptions.ErfTol
+	}
+	if options.MaxIter == 0 {
+		options.MaxIter = DefaultFitOptions.MaxIter
+	}
+	if options.InitialEta == 0 {
+		options.InitialEta = DefaultFitOptions.InitialEta
+	}
+	if options.LineSearchSteps == 0 {
+		options.LineSearchSteps = DefaultFitOptions.LineSearchSteps
+	}
+	return options, nil
+}
+
+// FitByCG weighs the error of every row of the sample by sampleWeights, or equally if they are nil.
+// It calls progress, unless it is nil, after every iteration. When ctx is done, it stops and returns
+// the best network found so far together with ctx.Err().
+func FitByCG(ctx context.Context, networkFor func(w0 WeightVector) (NeuralNetwork, error), sampleX XSample, sampleT YSample, sampleWeights []float64, w0 WeightVector, options FitOptions, progress func(FitProgress)) (NeuralNetwork, error) {
+	options, err := options.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckSampleSizes(sampleX, sampleT); err != nil {
+		return nil, err
+	}
+	if sampleWeights != nil && len(sampleWeights) != len(sampleX) {
+		return nil, inputErrorf("SampleWeights", "expected a weight for each of the %d rows, got %d", len(sampleX), len(sampleWeights))
+	}
+	if _, err := networkFor(w0); err != nil {
+		return nil, err
+	}
+	// all weight vectors below have the length of w0, so networkFor can no longer fail
+	mustNetworkFor := func(w WeightVector) NeuralNetwork {
+		nn, err := networkFor(w)
+		if err != nil {
+			panic(err)
+		}
+		return nn
+	}
+
+	// w0 is the best network so far until the line searches are done, so they can be cancelled along the way
+	cancelled := func(tries int) (NeuralNetwork, error) {
+		os.Stderr.WriteString(fmt.Sprintf("fit cancelled after %d iterations...\n", tries))
+		return mustNetworkFor(w0), ctx.Err()
+	}
+
+	start := time.Now()
+	timeUp := func(tries int) bool {
+		if options.TimeBudget > 0 && time.Since(start) >= options.TimeBudget {
+			os.Stderr.WriteString(fmt.Sprintf("time budget used up after %d iterations...\n", tries))
+			return true
+		}
+		return false
+	}
+	eta := options.InitialEta
+
+fitting:
+	for tries := 0; tries < options.MaxIter; tries++ {
+		if timeUp(tries) {
+			break
+		}
+		if ctx.Err() != nil {
+			return cancelled(tries)
+		}
 
-	for tries := 0; tries < maxIter; tries++ {
-		n0 := networkFor(w0)
+		n0 := mustNetworkFor(w0)
 
-		gradient := GradientSample(n0, sampleX, sampleT)
+		gradient := WeightedGradientSample(n0, sampleX, sampleT, sampleWeights)
 
-		ErfValueW0 := ErfSampleValue(n0, sampleX, sampleT)
-		for et := 0; et <= 15; et++ {
-			if ErfSampleValue(networkFor(perturbed(w0, gradient, -eta)), sampleX, sampleT) < ErfValueW0 {
+		ErfValueW0 := WeightedErfSampleValue(n0, sampleX, sampleT, sampleWeights)
+		for et := 0; et <= options.LineSearchSteps; et++ {
+			if ctx.Err() != nil {
+				return cancelled(tries)
+			}
+			if timeUp(tries) {
+				break fitting
+			}
+			if WeightedErfSampleValue(mustNetworkFor(perturbed(w0, gradient, -eta)), sampleX, sampleT, sampleWeights) < ErfValueW0 {
 				break
 			}
 			eta /= 2
 		}
 
-		if verbose {
+		if options.Verbose {
 			os.Stderr.WriteString(fmt.Sprintf("decreasing eta to %f...\n", eta))
 		}
 
-		for et := 0; et <= 15; et++ {
-			if ErfSampleValue(networkFor(perturbed(w0, gradient, -2*eta)), sampleX, sampleT) >= ErfValueW0 {
+		for et := 0; et <= options.LineSearchSteps; et++ {
+			if ctx.Err() != nil {
+				return cancelled(tries)
+			}
+			if timeUp(tries) {
+				break fitting
+			}
+			if WeightedErfSampleValue(mustNetworkFor(perturbed(w0, gradient, -2*eta)), sampleX, sampleT, sampleWeights) >= ErfValueW0 {
 				break
 			}
 			eta *= 2
 		}
 
-		if verbose {
+		if options.Verbose {
 			os.Stderr.WriteString(fmt.Sprintf("increasing eta to %f...\n", eta))
 		}
 
 		w1 := perturbed(w0, gradient, -eta)
-		E_new := ErfSampleValue(networkFor(w1), sampleX, sampleT)
+		E_new := WeightedErfSampleValue(mustNetworkFor(w1), sampleX, sampleT, sampleWeights)
 
-		if ErfValueW0-E_new < erfTol || eta < 1e-15 {
+		if ErfValueW0-E_new < options.ErfTol || eta < 1e-15 {
 			os.Stderr.WriteString(fmt.Sprintf("found the best error funciton... %f\n", ErfValueW0))
-			return networkFor(w0)
+			return mustNetworkFor(w0), nil
 		}
 
-		if verbose {
+		if options.Verbose {
 			os.Stderr.WriteString(fmt.Sprintf("%f -> %f\n", ErfValueW0, E_new))
 		}
+		if progress != nil {
+			progress(FitProgress{tries + 1, E_new, eta, floats.Norm(gradient, 2), time.Since(start)})
+		}
 		w0 = w1
 	}
 
-	best_nn := networkFor(w0)
-	os.Stderr.WriteString(fmt.Sprintf("could not optimize error function beyond beyond %f...\n", ErfSampleValue(best_nn, sampleX, sampleT)))
-	return best_nn
+	best_nn := mustNetworkFor(w0)
+	os.Stderr.WriteString(fmt.Sprintf("could not optimize error function beyond beyond %f...\n", WeightedErfSampleValue(best_nn, sampleX, sampleT, sampleWeights)))
+	return best_nn, nil
 }
@@ -0,0 +1,146 @@
+package neuralnet
+
+// WeightTies are groups of packed weights that share a single parameter, given by their indexes. Every weight of
+// a group takes the value of the first one listed, and the gradient by each of them is the sum over the group.
+type WeightTies [][]int
+
+func (ties WeightTies) validate(count int, mask WeightMask) InputErrors {
+	var errs InputErrors
+	seen := make(map[int]bool)
+	for g, group := range ties {
+		if len(group) < 2 {
+			errs = append(errs, inputErrorAt("Ties", g, -1, "a group needs at least 2 weights, got %d", len(group)))
+		}
+		for j, i := range group {
+			switch {
+			case i < 0 || i >= count:
+				errs = append(errs, inputErrorAt("Ties", g, j, "no weight %d among the %d weights", i, count))
+			case seen[i]:
+				errs = append(errs, inputErrorAt("Ties", g, j, "weight %d is already tied", i))
+			case len(mask) == count && group[0] >= 0 && group[0] < count && mask[i] != mask[group[0]]:
+				errs = append(errs, inputErrorAt("Ties", g, j, "weight %d is %s, unlike weight %d", i, mask[i], group[0]))
+			}
+			seen[i] = true
+		}
+	}
+	return errs
+}
+
+// tie sets every tied weight to the first of its group. It returns wts itself when they agree already.
+func (ties WeightTies) tie(wts WeightVector) WeightVector {
+	tied, copied := wts, false
+	for _, group := range ties {
+		for _, i := range group[1:] {
+			if tied[i] != tied[group[0]] {
+				if !copied {
+					tied, copied = append(WeightVector{}, wts...), true
+				}
+				tied[i] = tied[group[0]]
+			}
+		}
+	}
+	return tied
+}
+
+// sum sets the gradient by every tied weight to the sum over its group.
+func (ties WeightTies) sum(gradient []float64) {
+	for _, group := range ties {
+		sum := 0.0
+		for _, i := range group {
+			sum += gradient[i]
+		}
+		for _, i := range group {
+			gradient[i] = sum
+		}
+	}
+}
+
+// untied tells the weights that are parameters of their own: the ones that aren't tied and the first of each group.
+func (ties WeightTies) untied(count int) []bool {
+	untied := make([]bool, count)
+	for i := range untied {
+		untied[i] = true
+	}
+	for _, group := range ties {
+		for _, i := range group[1:] {
+			untied[i] = false
+		}
+	}
+	return untied
+}
+
+// Parameters are the weights the optimizer fits: all weights but the tied ones after the first of their group,
+// in the order of the packed weights.
+func (structure *NNStructure) Parameters(wts WeightVector) WeightVector {
+	if structure.Ties == nil {
+		return wts
+	}
+	var params WeightVector
+	for i, own := range structure.Ties.untied(len(wts)) {
+		if own {
+			params = append(params, wts[i])
+		}
+	}
+	return params
+}
+
+// Weights expands the parameters back into packed weights.
+func (structure *NNStructure) Weights(params WeightVector) WeightVector {
+	if structure.Ties == nil {
+		return params
+	}
+	wts := make(WeightVector, 0, structure.packedWeightsCount())
+	p := 0
+	for _, own := range structure.Ties.untied(structure.packedWeightsCount()) {
+		if own {
+			wts = append(wts, params[p])
+			p++
+		} else {
+			wts = append(wts, 0)
+		}
+	}
+	return structure.Ties.tie(wts)
+}
+
+func (structure *NNStructure) parametersCount() int {
+	count := 0
+	for _, own := range structure.Ties.untied(structure.packedWeightsCount()) {
+		if own {
+			count++
+		}
+	}
+	return count
+}
+
+// ForParameters is ForWeights for the parameters of a structure with tied weights, see Parameters. The network
+// reports the parameters as its PackedWts and the gradient by them, so FitByCG fits them as they are.
+func (structure *NNStructure) ForParameters(params WeightVector) (NeuralNetwork, error) {
+	if structure.Ties == nil {
+		return structure.ForWeights(params)
+	}
+	if errs := structure.Ties.validate(structure.packedWeightsCount(), structure.Mask); len(errs) > 0 {
+		return nil, errs
+	}
+	if len(params) != structure.parametersCount() {
+		return nil, inputErrorf("Wts", "invalid number of parameters %d != %d", len(params), structure.parametersCount())
+	}
+	nn, err := structure.ForWeights(structure.Weights(params))
+	if err != nil {
+		return nil, err
+	}
+	return &tiedNN{nn, structure, params}, nil
+}
+
+type tiedNN struct {
+	NeuralNetwork
+	structure *NNStructure
+	params    WeightVector
+}
+
+func (nn *tiedNN) PackedWts() []float64 {
+	return nn.params
+}
+
+func (nn *tiedNN) Gradient(x XVector, t YVector) WeightVector {
+	return nn.structure.Parameters(nn.NeuralNetwork.Gradient(x, t))
+}
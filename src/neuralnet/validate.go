@@ -0,0 +1,147 @@
+package neuralnet
+
+import "math"
+
+// ValidateWeights reports every problem with the weights as InputErrors: a length that doesn't fit the
+// structure, values that aren't finite, and a Mask or Ties that don't fit them.
+func (structure *NNStructure) ValidateWeights(wts WeightVector) error {
+	var errs InputErrors
+	if len(wts) != structure.packedWeightsCount() {
+		errs = append(errs, inputErrorAt("Wts", -1, -1, "invalid length of weights %d != %d", len(wts), structure.packedWeightsCount()))
+	}
+	for i, w := range wts {
+		if !isFinite(w) {
+			errs = append(errs, inputErrorAt("Wts", i, -1, "weight is not finite: %g", w))
+		}
+	}
+	errs = append(errs, structure.Mask.validate(structure.packedWeightsCount())...)
+	errs = append(errs, structure.Ties.validate(structure.packedWeightsCount(), structure.Mask)...)
+	return errs.orNil()
+}
+
+// ValidateSample reports every problem with the sample as InputErrors: rows of X and T that don't match in
+// number or don't fit the structure in width, and values that aren't finite. Targets may be NaN, which marks them
+// as missing. A nil t checks x alone.
+func (structure *NNStructure) ValidateSample(x XSample, t YSample) error {
+	var errs InputErrors
+	if len(x) == 0 {
+		errs = append(errs, inputErrorAt("X", -1, -1, "the sample has no rows"))
+	}
+	xs := make([][]float64, len(x))
+	for i := range x {
+		xs[i] = x[i]
+	}
+	xWidth, tWidth := structure.D, structure.K
+	if structure.Recurrent != nil {
+		// the widths depend on the number of steps
+		xWidth, tWidth = 0, 0
+		errs = append(errs, structure.validateSequences(x, t)...)
+	}
+	errs = append(errs, validateRows("X", xs, xWidth, false)...)
+
+	if t != nil {
+		if len(t) != len(x) {
+			errs = append(errs, inputErrorAt("T", -1, -1, "sample sizes of X and T differ: %d != %d", len(x), len(t)))
+		}
+		ts := make([][]float64, len(t))
+		for i := range t {
+			ts[i] = t[i]
+		}
+		errs = append(errs, validateRows("T", ts, tWidth, true)...)
+		if structure.ResponseType == Poisson || structure.ResponseType == NegativeBinomial {
+			errs = append(errs, validateCounts(ts)...)
+		}
+		if structure.ResponseType == MulticlassClassifier {
+			errs = append(errs, validateProbabilities(ts, structure.K)...)
+		}
+	}
+	return errs.orNil()
+}
+
+// ValidateSampleWeights reports weights that don't match the rows of the sample in number, or that are negative or
+// not finite. Nil weights are valid, they weigh every row equally.
+func ValidateSampleWeights(weights []float64, rows int) error {
+	if weights == nil {
+		return nil
+	}
+	var errs InputErrors
+	if len(weights) != rows {
+		errs = append(errs, inputErrorAt("SampleWeights", -1, -1, "expected a weight for each of the %d rows, got %d", rows, len(weights)))
+	}
+	for i, w := range weights {
+		if !isFinite(w) || w < 0 {
+			errs = append(errs, inputErrorAt("SampleWeights", i, -1, "weight must be finite and not negative, got %g", w))
+		}
+	}
+	return errs.orNil()
+}
+
+// validateRows takes NaN values for missing ones if missing is set, and rows of any width if width is 0.
+func validateRows(field string, rows [][]float64, width int, missing bool) InputErrors {
+	var errs InputErrors
+	for i, row := range rows {
+		if width != 0 && len(row) != width {
+			errs = append(errs, inputErrorAt(field, i, -1, "row has %d values instead of %d", len(row), width))
+		}
+		for j, v := range row {
+			if !isFinite(v) && !(missing && math.IsNaN(v)) {
+				errs = append(errs, inputErrorAt(field, i, j, "value is not finite: %g", v))
+			}
+		}
+	}
+	return errs
+}
+
+func validateCounts(rows [][]float64) InputErrors {
+	var errs InputErrors
+	for i, row := range rows {
+		for j, v := range row {
+			if v < 0 {
+				errs = append(errs, inputErrorAt("T", i, j, "count can't be negative: %g", v))
+			}
+		}
+	}
+	return errs
+}
+
+// validateProbabilities checks that the targets of every K classes are distributions over them, which the
+// canonical delta y - t of softmax outputs relies on. Rows of recurrent networks may hold several of them.
+// Targets can only be missing for all K classes together.
+func validateProbabilities(rows [][]float64, K int) InputErrors {
+	var errs InputErrors
+	for i, row := range rows {
+		for start := 0; start+K <= len(row); start += K {
+			if err := validateDistribution(row[start : start+K]); err != "" {
+				errs = append(errs, inputErrorAt("T", i, -1, "targets of a multiclass network %s", err))
+				break
+			}
+		}
+	}
+	return errs
+}
+
+func validateDistribution(classes []float64) string {
+	sum, negative, missing := 0.0, false, 0
+	for _, v := range classes {
+		if math.IsNaN(v) {
+			missing++
+			continue
+		}
+		sum += v
+		negative = negative || v < 0
+	}
+	switch {
+	case missing == len(classes):
+		return ""
+	case missing > 0:
+		return "can't be missing for some classes only"
+	case math.Abs(sum-1) > 1e-9 || negative:
+		return "must be class probabilities summing to 1"
+	default:
+		return ""
+	}
+}
+
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
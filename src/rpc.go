@@ -0,0 +1,266 @@
+package main
+
+import (
+	"./neuralnet"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// JSON-RPC 2.0 framing of the requests, see https://www.jsonrpc.org/specification.
+// The params of every method are a Request object, the result is a Result, except for describe.
+const rpcVersion = "2.0"
+
+const (
+	rpcParseErrorCode     = -32700
+	rpcInvalidRequestCode = -32600
+	rpcMethodNotFoundCode = -32601
+	rpcInvalidParamsCode  = -32602
+	rpcInternalErrorCode  = -32603
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	Id      json.RawMessage `json:"id"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	Id      json.RawMessage `json:"id"`
+}
+
+// rpcNotification is sent by the worker with the progress of fits whose params ask for it.
+type rpcNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type rpcProgress struct {
+	Id       json.RawMessage `json:"id"`
+	Progress ProgressReport
+}
+
+type rpcError struct {
+	Code    int        `json:"code"`
+	Message string     `json:"message"`
+	Data    *ErrorInfo `json:"data,omitempty"`
+}
+
+type methodNotFoundError string
+
+func (e methodNotFoundError) Error() string {
+	return "method not found: " + string(e)
+}
+
+// Description is the result of the describe method.
+type Description struct {
+	Model        string `json:",omitempty"`
+	NetworkRT    neuralnet.NetworkResponseType
+	Order        neuralnet.NNOrder
+	WeightsCount int
+}
+
+// rpcMethod returns the method of a single call, or "" if there is none.
+func rpcMethod(raw json.RawMessage) string {
+	probe := struct {
+		Method string `json:"method"`
+	}{}
+	json.Unmarshal(raw, &probe)
+	return probe.Method
+}
+
+// isRPC tells JSON-RPC messages, which are either batches or objects with a jsonrpc member, from legacy requests.
+func isRPC(raw json.RawMessage) bool {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		return true
+	}
+	probe := struct {
+		JSONRPC *string `json:"jsonrpc"`
+	}{}
+	return json.Unmarshal(trimmed, &probe) == nil && probe.JSONRPC != nil
+}
+
+// looksLikeRPC guesses whether malformed input was meant as a JSON-RPC message, to answer it in kind.
+func looksLikeRPC(text string) bool {
+	trimmed := strings.TrimSpace(text)
+	return strings.HasPrefix(trimmed, "[") || strings.Contains(trimmed, `"jsonrpc"`)
+}
+
+// respondRPC serves a single message or a batch. It returns nil when there is nothing to answer,
+// i.e. for notifications.
+func (ws *workspace) respondRPC(ctx context.Context, raw json.RawMessage, emit func(interface{})) interface{} {
+	trimmed := bytes.TrimSpace(raw)
+	if trimmed[0] != '[' {
+		if response, ok := ws.serveRPC(ctx, trimmed, emit); ok {
+			return response
+		}
+		return nil
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(trimmed, &batch); err != nil || len(batch) == 0 {
+		return rpcResponse{rpcVersion, nil, &rpcError{rpcInvalidRequestCode, "expected a non-empty batch of requests", nil}, nil}
+	}
+	var responses []rpcResponse
+	for _, message := range batch {
+		if response, ok := ws.serveRPC(ctx, message, emit); ok {
+			responses = append(responses, response)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+	return responses
+}
+
+func (ws *workspace) serveRPC(ctx context.Context, raw json.RawMessage, emit func(interface{})) (response rpcResponse, reply bool) {
+	call := rpcRequest{}
+	if err := json.Unmarshal(raw, &call); err != nil || call.JSONRPC != rpcVersion || call.Method == "" {
+		return rpcResponse{rpcVersion, nil, &rpcError{rpcInvalidRequestCode, "invalid request", nil}, call.Id}, true
+	}
+	reply = call.Id != nil // no id means a notification
+
+	defer func() {
+		if r := recover(); r != nil {
+			response = rpcErrorResponse(call.Id, internalError(fmt.Sprint(r)))
+		}
+	}()
+
+	if call.Method == CancelCommand {
+		return ws.cancelRPC(call), reply
+	}
+
+	request := Request{}
+	if len(call.Params) > 0 {
+		if err := json.Unmarshal(call.Params, &request); err != nil {
+			return rpcErrorResponse(call.Id, decodeError(err)), reply
+		}
+	}
+
+	hooks := progressHooks(request.ProgressEvery, emit, func(report ProgressReport) interface{} {
+		return rpcNotification{rpcVersion, "progress", rpcProgress{call.Id, report}}
+	})
+	hooks.ctx = ctx
+	if call.Id != nil {
+		var done func()
+		hooks.ctx, done = ws.track(ctx, rpcKey(call.Id))
+		defer done()
+	}
+
+	result, err := ws.call(call.Method, request, hooks)
+	if err != nil {
+		if _, ok := err.(methodNotFoundError); ok {
+			return rpcResponse{rpcVersion, nil, &rpcError{rpcMethodNotFoundCode, err.Error(), nil}, call.Id}, reply
+		}
+		return rpcErrorResponse(call.Id, errorResponse(err).Error), reply
+	}
+	return rpcResponse{rpcVersion, result, nil, call.Id}, reply
+}
+
+// call maps the methods to commands, or to evaluating a standalone request when no Model is named.
+func (ws *workspace) call(method string, request Request, hooks fitHooks) (interface{}, error) {
+	request.Command = ""
+	switch method {
+	case "evaluate":
+		request.ShouldFit = false
+		return ws.run(request, hooks)
+	case FitCommand:
+		if request.Model != "" {
+			request.Command = FitCommand
+		}
+		request.ShouldFit = true
+		return ws.run(request, hooks)
+	case PredictCommand:
+		if request.Model != "" {
+			request.Command = PredictCommand
+			return ws.run(request, hooks)
+		}
+		request.ShouldFit = false
+		result, err := ws.run(request, hooks)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Predicted: result.Predicted, Hidden: result.Hidden, StdDev: result.StdDev, Modes: result.Modes, Draws: result.Draws}, nil
+	case GradientCommand:
+		if request.Model != "" {
+			request.Command = GradientCommand
+			return ws.run(request, hooks)
+		}
+		request.ShouldFit = false
+		result, err := ws.run(request, hooks)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{ErfValue: result.ErfValue, Gradient: result.Gradient}, nil
+	case CreateCommand, DeleteCommand:
+		request.Command = method
+		return ws.run(request, hooks)
+	case "describe":
+		return ws.describe(request)
+	default:
+		return nil, methodNotFoundError(method)
+	}
+}
+
+func (ws *workspace) describe(request Request) (*Description, error) {
+	if request.Model != "" {
+		m, err := ws.model(request)
+		if err != nil {
+			return nil, err
+		}
+		return &Description{request.Model, m.responseType, m.structure.NNOrder, len(m.wts)}, nil
+	}
+
+	structure, err := requestStructure(request)
+	if err != nil {
+		return nil, err
+	}
+	count, err := structure.ExpectedPackedWeightsCount()
+	if err != nil {
+		return nil, err
+	}
+	return &Description{"", responseType(request), structure.NNOrder, count}, nil
+}
+
+// cancelRPC cancels the running call whose id is given in params, as in {"id": 7}.
+func (ws *workspace) cancelRPC(call rpcRequest) rpcResponse {
+	target := struct {
+		Id json.RawMessage `json:"id"`
+	}{}
+	if err := json.Unmarshal(call.Params, &target); err != nil || target.Id == nil {
+		return rpcErrorResponse(call.Id, invalidInput("the id of the call to cancel is required", "id"))
+	}
+	if !ws.cancel(rpcKey(target.Id)) {
+		return rpcErrorResponse(call.Id, invalidInput("no running call with id "+string(target.Id), "id"))
+	}
+	return rpcResponse{rpcVersion, true, nil, call.Id}
+}
+
+func rpcKey(id json.RawMessage) string {
+	compact := &bytes.Buffer{}
+	if err := json.Compact(compact, id); err != nil {
+		return string(id)
+	}
+	return compact.String()
+}
+
+func rpcErrorResponse(id json.RawMessage, info ErrorInfo) rpcResponse {
+	code := rpcInternalErrorCode
+	switch info.Code {
+	case DecodeError, InvalidInput:
+		code = rpcInvalidParamsCode
+	}
+	return rpcResponse{rpcVersion, nil, &rpcError{code, info.Message, &info}, id}
+}
+
+func rpcParseError(err error) rpcResponse {
+	return rpcResponse{rpcVersion, nil, &rpcError{rpcParseErrorCode, err.Error(), nil}, nil}
+}
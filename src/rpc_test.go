@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSONRPCMethods(t *testing.T) {
+	input := strings.Join([]string{
+		`{"jsonrpc": "2.0", "id": 1, "method": "describe", "params": {"Order": {"D":2,"M":[3,2],"K":3}, "NetworkRT": "binary"}}`,
+		`{"jsonrpc": "2.0", "id": "two", "method": "fit", "params": {"Order": {"D":2,"M":[4],"K":3}, "X": [[1,1]], "T": [[1,2,3]]}}`,
+		`{"jsonrpc": "2.0", "method": "evaluate", "params": {"Order": {"D":2,"M":[4],"K":3}}}`,
+		`{"Id": "legacy", "Order": {"D":2,"M":[4],"K":3}}`,
+		`{"jsonrpc": "2.0", "id": 3, "method": "train"}`,
+		`{"jsonrpc": "2.0", "id": 4, "method": "predict", "params": {"Order": {"D":2,"M":[],"K":3}}}`,
+		`{"jsonrpc": "1.0", "id": 5, "method": "predict"}`,
+		`[{"jsonrpc": "2.0", "id": 6, "method": "predict", "params": {"Order": {"D":2,"M":[4],"K":3}, "X": [[1,1],[2,2]]}}, 7]`,
+		`{"jsonrpc": "2.0", "id": 8, bad`,
+		`{"Id": "broken", bad`,
+	}, "\n")
+
+	responses := runServeJSON(t, input, 1, true)
+	if len(responses) != 9 {
+		t.Fatalf("expected a response for every request but the notification, got %d", len(responses))
+	}
+
+	describe := struct{ Result Description }{}
+	if err := json.Unmarshal(responses[0], &describe); err != nil || describe.Result.WeightsCount != 26 || describe.Result.NetworkRT != "binary" {
+		t.Errorf("expected a description of the network, got %s", responses[0])
+	}
+
+	fit := rpcResult(t, responses[1], `"two"`)
+	if len(fit.Wts) != 27 || *fit.ErfValue > 1e-6 {
+		t.Errorf("expected a fitted network, got %s", responses[1])
+	}
+
+	legacy := Result{}
+	if err := json.Unmarshal(responses[2], &legacy); err != nil || legacy.Id != "legacy" {
+		t.Errorf("expected a legacy result, got %s", responses[2])
+	}
+
+	expectRPCError(t, responses[3], `3`, rpcMethodNotFoundCode)
+	expectRPCError(t, responses[4], `4`, rpcInvalidParamsCode)
+	expectRPCError(t, responses[5], `5`, rpcInvalidRequestCode)
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(responses[6], &batch); err != nil || len(batch) != 2 {
+		t.Fatalf("expected a batch of two responses, got %s", responses[6])
+	}
+	predict := rpcResult(t, batch[0], `6`)
+	if len(predict.Predicted) != 2 || predict.Gradient != nil {
+		t.Errorf("expected predictions only, got %s", batch[0])
+	}
+	expectRPCError(t, batch[1], `null`, rpcInvalidRequestCode)
+
+	expectRPCError(t, responses[7], `null`, rpcParseErrorCode)
+	expectErrorResponse(t, responses[8], "", DecodeError, "") // malformed legacy requests keep their format
+}
+
+func TestJSONRPCCancelOfUnknownCall(t *testing.T) {
+	responses := runServeJSON(t, `{"jsonrpc": "2.0", "id": 1, "method": "cancel", "params": {"id": 7}}`, 1, false)
+	expectRPCError(t, responses[0], `1`, rpcInvalidParamsCode)
+}
+
+func rpcResult(t *testing.T, raw json.RawMessage, id string) Result {
+	response := struct {
+		JSONRPC string `json:"jsonrpc"`
+		Id      json.RawMessage
+		Result  Result
+	}{}
+	if err := json.Unmarshal(raw, &response); err != nil || response.JSONRPC != rpcVersion || string(response.Id) != id {
+		t.Fatalf("expected a JSON-RPC response with id %s, got %s", id, raw)
+	}
+	return response.Result
+}
+
+func expectRPCError(t *testing.T, raw json.RawMessage, id string, code int) {
+	response := rpcResponse{}
+	if err := json.Unmarshal(raw, &response); err != nil || response.Error == nil || response.Error.Code != code || string(response.Id) != id {
+		t.Errorf("expected JSON-RPC error %d for id %s, got %s", code, id, raw)
+	}
+}
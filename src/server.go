@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+func serveMain(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:8080", "address to listen on")
+	workers := flags.Int("workers", 1, "number of requests served concurrently")
+	flags.Parse(args)
+
+	if *workers < 1 {
+		fmt.Fprintf(os.Stderr, "invalid number of workers: %d\n", *workers)
+		os.Exit(2)
+	}
+
+	os.Stderr.WriteString(fmt.Sprintf("listening on %s...\n", *addr))
+	if err := http.ListenAndServe(*addr, newHTTPHandler(*workers)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// newHTTPHandler serves the same requests as the stdin/stdout loop, one endpoint per kind of result.
+// Each endpoint expects a POSTed Request and answers with the part of the Result it is named after.
+func newHTTPHandler(workers int) http.Handler {
+	slots := make(chan struct{}, workers)
+	ws := newWorkspace()
+
+	mux := http.NewServeMux()
+	mux.Handle("/fit", endpoint(ws, slots, true, func(result *Result) *Result {
+		return result
+	}))
+	mux.Handle("/predict", endpoint(ws, slots, false, func(result *Result) *Result {
+		return &Result{Id: result.Id, Predicted: result.Predicted, StdDev: result.StdDev, Modes: result.Modes, Draws: result.Draws}
+	}))
+	mux.Handle("/gradient", endpoint(ws, slots, false, func(result *Result) *Result {
+		return &Result{Id: result.Id, ErfValue: result.ErfValue, Gradient: result.Gradient}
+	}))
+	mux.Handle("/hidden", endpoint(ws, slots, false, func(result *Result) *Result {
+		return &Result{Id: result.Id, Hidden: result.Hidden}
+	}))
+	return mux
+}
+
+func endpoint(ws *workspace, slots chan struct{}, shouldFit bool, view func(*Result) *Result) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeHTTPResponse(w, http.StatusMethodNotAllowed, ErrorResponse{Error: invalidInput("only POST is supported", "")})
+			return
+		}
+
+		request := Request{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeHTTPResponse(w, http.StatusBadRequest, ErrorResponse{request.Id, decodeError(err)})
+			return
+		}
+		if request.Command != "" {
+			writeHTTPResponse(w, http.StatusBadRequest, ErrorResponse{request.Id, invalidInput("commands are only served on stdin/stdout", "Command")})
+			return
+		}
+		request.ShouldFit = shouldFit
+
+		slots <- struct{}{}
+		response := ws.respond(r.Context(), request, nil) // stops fitting when the client goes away
+		<-slots
+
+		switch resp := response.(type) {
+		case *Result:
+			writeHTTPResponse(w, http.StatusOK, view(resp))
+		case ErrorResponse:
+			writeHTTPResponse(w, statusOf(resp.Error), resp)
+		default:
+			writeHTTPResponse(w, http.StatusInternalServerError, ErrorResponse{request.Id, internalError(fmt.Sprintf("unexpected response %v", resp))})
+		}
+	})
+}
+
+func statusOf(info ErrorInfo) int {
+	switch info.Code {
+	case DecodeError, InvalidInput:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeHTTPResponse(w http.ResponseWriter, status int, response interface{}) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		// e.g. NaN or Inf in the result, which JSON can't represent
+		status = http.StatusInternalServerError
+		body, _ = json.Marshal(ErrorResponse{responseId(response), internalError(fmt.Sprintf("can't encode result: %v", err))})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPEndpoints(t *testing.T) {
+	server := httptest.NewServer(newHTTPHandler(2))
+	defer server.Close()
+
+	request := `{"Id": "r", "Order": {"D":2,"M":[4],"K":3}, "X": [[1,1]], "T": [[1,2,3]]}`
+
+	result := postForResult(t, server.URL+"/fit", request, http.StatusOK)
+	if result.Id != "r" || len(result.Wts) != 27 || *result.ErfValue > 1e-6 {
+		t.Errorf("expected a fitted result, got %+v", result)
+	}
+
+	result = postForResult(t, server.URL+"/predict", request, http.StatusOK)
+	if len(result.Predicted) != 1 || result.Wts != nil || result.Gradient != nil {
+		t.Errorf("expected only predictions, got %+v", result)
+	}
+
+	result = postForResult(t, server.URL+"/gradient", request, http.StatusOK)
+	if len(result.Gradient) != 27 || result.ErfValue == nil || result.Predicted != nil {
+		t.Errorf("expected only the error function and its gradient, got %+v", result)
+	}
+
+	result = postForResult(t, server.URL+"/hidden", request, http.StatusOK)
+	if len(result.Hidden) != 1 || len(result.Hidden[0]) != 4 || result.Predicted != nil {
+		t.Errorf("expected only the hidden units, got %+v", result)
+	}
+}
+
+func TestHTTPErrorStatuses(t *testing.T) {
+	server := httptest.NewServer(newHTTPHandler(1))
+	defer server.Close()
+
+	postForResult(t, server.URL+"/predict", `{"Order": {"D":2,"M":[],"K":3}}`, http.StatusBadRequest)
+	postForResult(t, server.URL+"/predict", `{"Order": `, http.StatusBadRequest)
+	postForResult(t, server.URL+"/predict", `{"Command": "predict", "Model": "m"}`, http.StatusBadRequest)
+
+	resp, err := http.Get(server.URL + "/predict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be refused, got %d", resp.StatusCode)
+	}
+}
+
+func postForResult(t *testing.T, url string, body string, status int) Result {
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != status {
+		t.Errorf("%s: expected status %d, got %d", url, status, resp.StatusCode)
+	}
+	result := Result{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("%s: can't decode response: %v", url, err)
+	}
+	return result
+}
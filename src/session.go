@@ -0,0 +1,347 @@
+package main
+
+import (
+	"./neuralnet"
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// Commands operating on models and datasets kept in the worker between requests.
+// A request without a Command is evaluated on its own, as it always was.
+const (
+	CreateCommand   = "create"
+	PredictCommand  = "predict"
+	FitCommand      = "fit"
+	GradientCommand = "gradient"
+	DeleteCommand   = "delete"
+	// CancelCommand stops the fit of the running request with the Id given in Cancel.
+	CancelCommand = "cancel"
+)
+
+type model struct {
+	structure    *neuralnet.NNStructure
+	responseType neuralnet.NetworkResponseType
+	wts          neuralnet.WeightVector
+}
+
+type dataset struct {
+	x       neuralnet.XSample
+	t       neuralnet.YSample
+	weights []float64
+}
+
+type runningRequest struct {
+	cancel context.CancelFunc
+}
+
+// workspace holds the named models and datasets created by the client, and the requests being served.
+type workspace struct {
+	mu       sync.Mutex
+	models   map[string]*model
+	datasets map[string]*dataset
+	running  map[string]*runningRequest
+}
+
+func newWorkspace() *workspace {
+	return &workspace{models: map[string]*model{}, datasets: map[string]*dataset{}, running: map[string]*runningRequest{}}
+}
+
+// track returns a context for serving the request known by key, which ws.cancel(key) cancels until done is called.
+func (ws *workspace) track(parent context.Context, key string) (ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancel(parent)
+	r := &runningRequest{cancel}
+
+	ws.mu.Lock()
+	ws.running[key] = r
+	ws.mu.Unlock()
+
+	return ctx, func() {
+		ws.mu.Lock()
+		if ws.running[key] == r {
+			delete(ws.running, key)
+		}
+		ws.mu.Unlock()
+		cancel()
+	}
+}
+
+func (ws *workspace) cancel(key string) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	r, ok := ws.running[key]
+	if ok {
+		r.cancel()
+	}
+	return ok
+}
+
+// legacyKey spells request ids as JSON-RPC ids, so that both share the namespace of running requests.
+func legacyKey(id string) string {
+	key, _ := json.Marshal(id)
+	return string(key)
+}
+
+func (ws *workspace) run(request Request, hooks fitHooks) (*Result, error) {
+	if request.XSequences != nil {
+		if request.X != nil {
+			return nil, invalidInput("either X or XSequences can be given", "XSequences")
+		}
+		request.X = request.XSequences.Flatten()
+	}
+	if request.TSequences != nil {
+		if request.T != nil {
+			return nil, invalidInput("either T or TSequences can be given", "TSequences")
+		}
+		request.T = request.TSequences.Flatten()
+	}
+	if request.TMask != nil {
+		if request.T == nil {
+			return nil, invalidInput("TMask is given without T", "TMask")
+		}
+		t, err := neuralnet.MaskTargets(request.T, request.TMask)
+		if err != nil {
+			return nil, err
+		}
+		request.T = t
+	}
+
+	switch request.Command {
+	case "":
+		return evaluate(request, hooks)
+	case CreateCommand:
+		return ws.create(request)
+	case PredictCommand:
+		return ws.predict(request)
+	case FitCommand:
+		return ws.fit(request, hooks)
+	case GradientCommand:
+		return ws.gradient(request)
+	case DeleteCommand:
+		return ws.delete(request)
+	case CancelCommand:
+		if request.Cancel == "" {
+			return nil, invalidInput("the Id of the request to cancel is required", "Cancel")
+		}
+		if !ws.cancel(legacyKey(request.Cancel)) {
+			return nil, invalidInput("no running request with Id "+request.Cancel, "Cancel")
+		}
+		return &Result{}, nil
+	default:
+		return nil, invalidInput("unknown command "+request.Command, "Command")
+	}
+}
+
+// create stores the model described by Order, NetworkRT and Wts under the Model name, and X and T under the
+// Dataset name. Either of them can be left out. Existing models and datasets of the same name are replaced.
+func (ws *workspace) create(request Request) (*Result, error) {
+	if request.Model == "" && request.Dataset == "" {
+		return nil, invalidInput("a Model or Dataset name is required", "Model")
+	}
+
+	var m *model
+	if request.Model != "" {
+		structure, err := requestStructure(request)
+		if err != nil {
+			return nil, err
+		}
+		wts := request.Wts
+		if wts == nil {
+			if wts, err = defaultWeights(structure); err != nil {
+				return nil, err
+			}
+		}
+		if err := structure.ValidateWeights(wts); err != nil {
+			return nil, err
+		}
+		m = &model{structure, responseType(request), wts}
+	}
+
+	var data *dataset
+	if request.Dataset != "" {
+		if request.X == nil {
+			return nil, invalidInput("X is required to create a dataset", "X")
+		}
+		if request.T != nil {
+			if err := neuralnet.CheckSampleSizes(request.X, request.T); err != nil {
+				return nil, err
+			}
+		}
+		if err := neuralnet.ValidateSampleWeights(request.SampleWeights, len(request.X)); err != nil {
+			return nil, err
+		}
+		data = &dataset{request.X, request.T, request.SampleWeights}
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	result := &Result{Model: request.Model, Dataset: request.Dataset}
+	if m != nil {
+		ws.models[request.Model] = m
+		result.Wts = m.wts
+	}
+	if data != nil {
+		ws.datasets[request.Dataset] = data
+	}
+	return result, nil
+}
+
+func (ws *workspace) predict(request Request) (*Result, error) {
+	m, err := ws.model(request)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ws.sample(request, false)
+	if err != nil {
+		return nil, err
+	}
+	x := data.x
+	if err := neuralnet.Merge(m.structure.ValidateSample(x, nil), checkMixtureRequest(request, m.structure)); err != nil {
+		return nil, err
+	}
+	nn, err := m.structure.ForWeights(m.wts)
+	if err != nil {
+		return nil, err
+	}
+
+	predicted, stddev := neuralnet.MomentsSample(m.structure, nn, x)
+	modes, draws := mixtureResults(request, m.structure, nn, x)
+
+	return &Result{
+		Model:     request.Model,
+		Dataset:   request.Dataset,
+		Predicted: predicted,
+		Hidden:    neuralnet.HiddenSample(nn, x),
+		StdDev:    stddev,
+		Modes:     modes,
+		Draws:     draws,
+	}, nil
+}
+
+// fit continues fitting from the model's current weights and keeps the result in the model.
+func (ws *workspace) fit(request Request, hooks fitHooks) (*Result, error) {
+	m, err := ws.model(request)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ws.sample(request, true)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := fullResult(request, m.structure, m.wts, data, true, hooks)
+	if err != nil {
+		return nil, err
+	}
+
+	ws.mu.Lock()
+	if ws.models[request.Model] == m {
+		ws.models[request.Model] = &model{m.structure, m.responseType, result.Wts}
+	}
+	ws.mu.Unlock()
+
+	result.Model = request.Model
+	result.Dataset = request.Dataset
+	return result, nil
+}
+
+func (ws *workspace) gradient(request Request) (*Result, error) {
+	m, err := ws.model(request)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ws.sample(request, true)
+	if err != nil {
+		return nil, err
+	}
+	x := data.x
+	t, err := m.structure.Targets(x, data.t)
+	if err != nil {
+		return nil, err
+	}
+	if err := neuralnet.Merge(m.structure.ValidateSample(x, t), neuralnet.ValidateSampleWeights(data.weights, len(x))); err != nil {
+		return nil, err
+	}
+	nn, err := m.structure.ForWeights(m.wts)
+	if err != nil {
+		return nil, err
+	}
+	erfValue := neuralnet.WeightedErfSampleValue(nn, x, t, data.weights)
+
+	return &Result{
+		Model:    request.Model,
+		Dataset:  request.Dataset,
+		ErfValue: &erfValue,
+		Gradient: neuralnet.WeightedGradientSample(nn, x, t, data.weights),
+	}, nil
+}
+
+func (ws *workspace) delete(request Request) (*Result, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if request.Model != "" {
+		if _, ok := ws.models[request.Model]; !ok {
+			return nil, invalidInput("unknown model "+request.Model, "Model")
+		}
+	}
+	if request.Dataset != "" {
+		if _, ok := ws.datasets[request.Dataset]; !ok {
+			return nil, invalidInput("unknown dataset "+request.Dataset, "Dataset")
+		}
+	}
+	delete(ws.models, request.Model)
+	delete(ws.datasets, request.Dataset)
+	return &Result{Model: request.Model, Dataset: request.Dataset}, nil
+}
+
+func (ws *workspace) model(request Request) (*model, error) {
+	if request.Model == "" {
+		return nil, invalidInput("a Model name is required", "Model")
+	}
+	if request.Mask != nil {
+		return nil, invalidInput("the mask of a model can only be set when the model is created", "Mask")
+	}
+	if request.Ties != nil {
+		return nil, invalidInput("the ties of a model can only be set when the model is created", "Ties")
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	m, ok := ws.models[request.Model]
+	if !ok {
+		return nil, invalidInput("unknown model "+request.Model, "Model")
+	}
+	return m, nil
+}
+
+// sample takes X and T from the request if given, and from the named dataset otherwise. The SampleWeights
+// of the request go with its X, the weights of the dataset with the dataset's X.
+func (ws *workspace) sample(request Request, needT bool) (*dataset, error) {
+	data := &dataset{request.X, request.T, request.SampleWeights}
+	if request.Dataset != "" && (data.x == nil || (needT && data.t == nil)) {
+		ws.mu.Lock()
+		stored, ok := ws.datasets[request.Dataset]
+		ws.mu.Unlock()
+		if !ok {
+			return nil, invalidInput("unknown dataset "+request.Dataset, "Dataset")
+		}
+		if data.x == nil {
+			data.x = stored.x
+			if data.weights == nil {
+				data.weights = stored.weights
+			}
+		}
+		if data.t == nil {
+			data.t = stored.t
+		}
+	}
+
+	if data.x == nil {
+		return nil, invalidInput("X or a Dataset is required", "X")
+	}
+	if needT && data.t == nil {
+		return nil, invalidInput("T or a Dataset with T is required", "T")
+	}
+	return data, nil
+}
@@ -2,12 +2,23 @@ package main
 
 import (
 	"./neuralnet"
+	"bufio"
+	"context"
 	"encoding/json"
+	"flag"
+	"fmt"
 	"io"
+	"math/rand"
 	"os"
+	"strings"
+	"time"
 )
 
 type Request struct {
+	Id        string
+	Command   string
+	Model     string
+	Dataset   string
 	ShouldFit bool
 	NetworkRT neuralnet.NetworkResponseType
 	Order     neuralnet.NNOrder
@@ -15,75 +26,407 @@ type Request struct {
 	X         neuralnet.XSample
 	T         neuralnet.YSample
 	Verbose   bool
+	// ProgressEvery asks for a ProgressMessage every that many iterations of fitting, if positive.
+	ProgressEvery int
+	// Cancel is the Id of the request to cancel with the cancel command.
+	Cancel string
+	// Options tune the fitting; the ones left out take their default values.
+	Options Options
+	// ResponseParams tune the error function of the huber and quantile response types, and give the number of
+	// Components of mixture networks.
+	ResponseParams neuralnet.ResponseParams
+	// XSequences and TSequences give the samples of recurrent networks as sequences of steps, in place of X and T.
+	// TSequences hold targets for every step, T may instead give the targets of the last step only.
+	XSequences neuralnet.XSequences
+	TSequences neuralnet.YSequences
+	// Mask is the state of every weight of Wts: trainable, frozen at its value, or absent, i.e. always 0.
+	// All weights are trainable if left out. Models keep the mask they are created with, which later requests
+	// on them can't give.
+	Mask neuralnet.WeightMask
+	// Ties are groups of indexes into Wts of weights that share a single parameter, taking the value of the
+	// first weight of the group. Models keep the ties they are created with, which later requests on them
+	// can't give.
+	Ties neuralnet.WeightTies
+	// TMask marks the targets of T that were observed true and the missing ones false, as JSON has no NaN.
+	// Missing targets add nothing to the error.
+	TMask [][]bool
+	// SampleWeights weigh the error of every row of X, for fitting as well as for ErfValue and Gradient.
+	// All rows weigh 1 if left out.
+	SampleWeights []float64
+	// Modes and Draws ask mixture networks for the modes of the predicted mixtures, and for that many
+	// random draws from each of them. Seed seeds the draws.
+	Modes bool
+	Draws int
+	Seed  int64
+	// Strict refuses requests leaving out Wts, X or T, instead of defaulting them.
+	Strict bool
+}
+
+// Options are the JSON form of neuralnet.FitOptions.
+type Options struct {
+	ErfTol          float64
+	MaxIter         int
+	TimeBudget      float64 // seconds, no limit if 0
+	InitialEta      float64
+	LineSearchSteps int
+}
+
+func (options Options) fitOptions(verbose bool) (neuralnet.FitOptions, error) {
+	return neuralnet.FitOptions{
+		ErfTol:          options.ErfTol,
+		MaxIter:         options.MaxIter,
+		TimeBudget:      time.Duration(options.TimeBudget * float64(time.Second)),
+		InitialEta:      options.InitialEta,
+		LineSearchSteps: options.LineSearchSteps,
+		Verbose:         verbose,
+	}.Resolve()
+}
+
+func optionsOf(fitOptions neuralnet.FitOptions) *Options {
+	return &Options{fitOptions.ErfTol, fitOptions.MaxIter, fitOptions.TimeBudget.Seconds(), fitOptions.InitialEta, fitOptions.LineSearchSteps}
 }
 
 type Result struct {
-	Wts       neuralnet.WeightVector
-	Predicted neuralnet.YSample
-	ErfValue  float64
-	Gradient  neuralnet.WeightVector
-	Hidden    [][]float64
+	Id        string                 `json:",omitempty"`
+	Model     string                 `json:",omitempty"`
+	Dataset   string                 `json:",omitempty"`
+	Wts       neuralnet.WeightVector `json:",omitempty"`
+	Predicted neuralnet.YSample      `json:",omitempty"`
+	ErfValue  *float64               `json:",omitempty"`
+	Gradient  neuralnet.WeightVector `json:",omitempty"`
+	Hidden    [][]float64            `json:",omitempty"`
+	// StdDev holds the standard deviations of the predictions, for response types that predict them.
+	StdDev neuralnet.YSample `json:",omitempty"`
+	// Modes and Draws hold the modes of and the draws from the mixtures predicted for each row of X.
+	Modes neuralnet.YSample   `json:",omitempty"`
+	Draws []neuralnet.YSample `json:",omitempty"`
+	// Cancelled is set when the fit was cancelled, the weights are then the best ones found until then.
+	Cancelled bool `json:",omitempty"`
+	// Options are the ones the fit used, defaults included.
+	Options *Options `json:",omitempty"`
+}
+
+// ProgressMessage is written while fitting for requests that ask for it, before their Result.
+type ProgressMessage struct {
+	Id       string `json:",omitempty"`
+	Progress ProgressReport
+}
+
+type ProgressReport struct {
+	Iteration    int
+	ErfValue     float64
+	Eta          float64
+	GradientNorm float64
+	Elapsed      float64 // seconds
+}
+
+func progressReport(p neuralnet.FitProgress) ProgressReport {
+	return ProgressReport{p.Iteration, p.ErfValue, p.Eta, p.GradientNorm, p.Elapsed.Seconds()}
+}
+
+// fitHooks connect a fit to the stream its request came from.
+type fitHooks struct {
+	ctx      context.Context
+	progress func(neuralnet.FitProgress)
+}
+
+func (hooks fitHooks) context() context.Context {
+	if hooks.ctx == nil {
+		return context.Background()
+	}
+	return hooks.ctx
+}
+
+// progressHooks emit the message made from every n-th progress report, if n is positive.
+func progressHooks(n int, emit func(interface{}), message func(ProgressReport) interface{}) fitHooks {
+	if emit == nil || n <= 0 {
+		return fitHooks{}
+	}
+	return fitHooks{progress: func(p neuralnet.FitProgress) {
+		if p.Iteration%n == 0 {
+			emit(message(progressReport(p)))
+		}
+	}}
 }
 
 func main() {
-	dec := json.NewDecoder(os.Stdin)
-	enc := json.NewEncoder(os.Stdout)
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serveMain(os.Args[2:])
+		return
+	}
+
+	workers := flag.Int("workers", 1, "number of requests served concurrently")
+	ordered := flag.Bool("ordered", false, "write results in the order the requests were received")
+	flag.Parse()
+
+	if *workers < 1 {
+		fmt.Fprintf(os.Stderr, "invalid number of workers: %d\n", *workers)
+		os.Exit(2)
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	binary, err := isBinaryStream(in)
+	if err != nil && err != io.EOF {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if binary {
+		serveBinary(in, os.Stdout, *workers, *ordered)
+	} else {
+		serveJSON(in, os.Stdout, *workers, *ordered)
+	}
+}
+
+// serveJSON reads requests from r until EOF and writes a response for each of them to w.
+func serveJSON(r io.Reader, w io.Writer, workers int, ordered bool) {
+	ws := newWorkspace()
+	out := newResponseWriter(json.NewEncoder(w))
+	d := newDispatcher(out, workers, ordered)
+	defer d.wait()
+
+	in := bufio.NewReader(r)
+	dec := json.NewDecoder(in)
 	for {
-		request := Request{}
+		var raw json.RawMessage
 
-		if err := dec.Decode(&request); err != nil {
-			if err != io.EOF {
-				panic(err)
+		if err := dec.Decode(&raw); err != nil {
+			if err == io.EOF {
+				return
+			}
+			// the decoder can't resume after malformed input, so drop the rest of the line, which starts with
+			// the malformed message
+			in = bufio.NewReader(io.MultiReader(dec.Buffered(), in))
+			line, skipErr := skipLine(in)
+			var response interface{} = errorResponse(decodeError(err))
+			if looksLikeRPC(line) {
+				response = rpcParseError(err)
 			}
-			return
+			d.submit(func() interface{} { return response })
+			if skipErr != nil {
+				return
+			}
+			dec = json.NewDecoder(in)
+			continue
 		}
 
-		w0 := request.Wts
-		if w0 == nil {
-			os.Stderr.WriteString("Wts not given, defaulting to 1s...\n")
-			w0 = make([]float64, request.Order.ExpectedPackedWeightsCount())
-			for i := range w0 {
-				w0[i] = 1
+		if isRPC(raw) {
+			if rpcMethod(raw) == CancelCommand {
+				out.write(ws.respondRPC(context.Background(), raw, nil)) // bypasses the queue, so it reaches running fits right away
+			} else {
+				d.submit(func() interface{} { return ws.respondRPC(context.Background(), raw, out.write) })
 			}
+			continue
 		}
 
-		x := request.X
-		if x == nil {
-			os.Stderr.WriteString("X not given, defaulting to 0.1s...\n")
-			x = make(neuralnet.XSample, 1)
-			x[0] = neuralnet.ArrayOfSize(request.Order.D, 0.1)
+		request := Request{}
+		if err := json.Unmarshal(raw, &request); err != nil {
+			response := errorResponse(decodeError(err))
+			response.Id = request.Id
+			d.submit(func() interface{} { return response })
+			continue
 		}
 
-		t := request.T
-		if t == nil {
-			os.Stderr.WriteString("T not given, defaulting to 1s...\n")
-			t = make(neuralnet.YSample, 1)
-			t[0] = neuralnet.ArrayOfSize(request.Order.K, 1.0)
+		if request.Command == CancelCommand {
+			out.write(ws.respond(context.Background(), request, nil)) // bypasses the queue, so it reaches running fits right away
+			continue
 		}
+		d.submit(func() interface{} { return ws.respond(context.Background(), request, out.write) })
+	}
+}
 
-		responseType := request.NetworkRT
-		if responseType == "" {
-			responseType = neuralnet.Regression
+// skipLine drops input up to the end of the first line that isn't blank, and returns that line.
+func skipLine(in *bufio.Reader) (string, error) {
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil || strings.TrimSpace(line) != "" {
+			return line, err
 		}
+	}
+}
 
-		var nn neuralnet.NeuralNetwork
-		if request.ShouldFit {
-			nn = neuralnet.FitByCG(request.Order.OfResponseType(responseType).ForWeights, x, t, w0, request.Verbose, 1e-12, 10000)
-		} else {
-			nn = request.Order.OfResponseType(responseType).ForWeights(w0)
+// respond serves the request, writing any messages sent before the response to emit.
+// Fitting stops early when ctx is done or when the request is cancelled by its Id.
+func (ws *workspace) respond(ctx context.Context, request Request, emit func(interface{})) (response interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			response = ErrorResponse{request.Id, internalError(fmt.Sprint(r))}
 		}
-		wts := nn.PackedWts()
-
-		result := Result{
-			wts,
-			neuralnet.PredictSample(nn, x),
-			neuralnet.ErfSampleValue(nn, x, t),
-			neuralnet.GradientSample(nn, x, t),
-			neuralnet.HiddenSample(nn, x),
+	}()
+
+	hooks := progressHooks(request.ProgressEvery, emit, func(report ProgressReport) interface{} {
+		return ProgressMessage{request.Id, report}
+	})
+	hooks.ctx = ctx
+	if request.Id != "" && request.Command != CancelCommand {
+		var done func()
+		hooks.ctx, done = ws.track(ctx, legacyKey(request.Id))
+		defer done()
+	}
+
+	result, err := ws.run(request, hooks)
+	if err != nil {
+		errResponse := errorResponse(err)
+		errResponse.Id = request.Id
+		return errResponse
+	}
+	result.Id = request.Id
+	return result
+}
+
+func evaluate(request Request, hooks fitHooks) (*Result, error) {
+	structure, err := requestStructure(request)
+	if err != nil {
+		return nil, err
+	}
+	if request.Strict {
+		if err := requireSample(request); err != nil {
+			return nil, err
+		}
+	}
+
+	w0 := request.Wts
+	if w0 == nil {
+		os.Stderr.WriteString("Wts not given, defaulting to 1s...\n")
+		if w0, err = defaultWeights(structure); err != nil {
+			return nil, err
+		}
+	}
+
+	x := request.X
+	if x == nil {
+		os.Stderr.WriteString("X not given, defaulting to 0.1s...\n")
+		x = make(neuralnet.XSample, 1)
+		x[0] = neuralnet.ArrayOfSize(request.Order.D, 0.1)
+	}
+
+	t := request.T
+	if t == nil {
+		os.Stderr.WriteString("T not given, defaulting to 1s...\n")
+		t = make(neuralnet.YSample, len(x))
+		for i := range t {
+			t[i] = neuralnet.ArrayOfSize(request.Order.K, 1.0)
+		}
+	}
+
+	return fullResult(request, structure, w0, &dataset{x, t, request.SampleWeights}, request.ShouldFit, hooks)
+}
+
+func requestStructure(request Request) (*neuralnet.NNStructure, error) {
+	structure, err := request.Order.OfResponse(responseType(request), request.ResponseParams)
+	if err != nil {
+		return nil, err
+	}
+	structure.Mask, structure.Ties = request.Mask, request.Ties
+	return structure, nil
+}
+
+func responseType(request Request) neuralnet.NetworkResponseType {
+	if request.NetworkRT == "" {
+		return neuralnet.Regression
+	}
+	return request.NetworkRT
+}
+
+// requireSample reports each of Wts, X and T missing from the request.
+func requireSample(request Request) error {
+	var errs neuralnet.InputErrors
+	for _, field := range []struct {
+		name    string
+		missing bool
+	}{{"Wts", request.Wts == nil}, {"X", request.X == nil}, {"T", request.T == nil}} {
+		if field.missing {
+			errs = append(errs, &neuralnet.InputError{Field: field.name, Row: -1, Col: -1, Message: field.name + " is required in strict mode"})
 		}
+	}
+	return neuralnet.Merge(errs)
+}
+
+func defaultWeights(structure *neuralnet.NNStructure) (neuralnet.WeightVector, error) {
+	count, err := structure.ExpectedPackedWeightsCount()
+	if err != nil {
+		return nil, err
+	}
+	return neuralnet.ArrayOfSize(count, 1.0), nil
+}
+
+// fullResult fits the network first if asked to, then reports everything there is to know about it on the sample.
+func fullResult(request Request, structure *neuralnet.NNStructure, w0 neuralnet.WeightVector, data *dataset, fit bool, hooks fitHooks) (*Result, error) {
+	x := data.x
+	t, err := structure.Targets(x, data.t)
+	if err != nil {
+		return nil, err
+	}
+	if err := neuralnet.Merge(structure.ValidateWeights(w0), structure.ValidateSample(x, t),
+		neuralnet.ValidateSampleWeights(data.weights, len(x)), checkMixtureRequest(request, structure)); err != nil {
+		return nil, err
+	}
+
+	var nn neuralnet.NeuralNetwork
+	var options *Options
+	if fit {
+		var fitOptions neuralnet.FitOptions
+		if fitOptions, err = request.Options.fitOptions(request.Verbose); err != nil {
+			return nil, err
+		}
+		options = optionsOf(fitOptions)
+		// the optimizer fits the parameters, i.e. a single one for each group of tied weights
+		nn, err = neuralnet.FitByCG(hooks.context(), structure.ForParameters, x, t, data.weights, structure.Parameters(w0), fitOptions, hooks.progress)
+		if nn != nil {
+			nn, _ = structure.ForWeights(structure.Weights(nn.PackedWts())) // can't fail, the parameters fit
+		}
+	} else {
+		nn, err = structure.ForWeights(w0)
+	}
+	cancelled := err == context.Canceled && nn != nil
+	if err != nil && !cancelled {
+		return nil, err
+	}
+	erfValue := neuralnet.WeightedErfSampleValue(nn, x, t, data.weights)
+	predicted, stddev := neuralnet.MomentsSample(structure, nn, x)
+	modes, draws := mixtureResults(request, structure, nn, x)
+
+	return &Result{
+		Wts:       nn.PackedWts(),
+		Predicted: predicted,
+		ErfValue:  &erfValue,
+		Gradient:  neuralnet.WeightedGradientSample(nn, x, t, data.weights),
+		Hidden:    neuralnet.HiddenSample(nn, x),
+		StdDev:    stddev,
+		Modes:     modes,
+		Draws:     draws,
+		Cancelled: cancelled,
+		Options:   options,
+	}, nil
+}
 
-		if err := enc.Encode(result); err != nil {
-			panic(err)
+func checkMixtureRequest(request Request, structure *neuralnet.NNStructure) error {
+	if request.Draws < 0 {
+		return invalidInput("the number of draws can't be negative", "Draws")
+	}
+	if (request.Modes || request.Draws > 0) && structure.ResponseType != neuralnet.MixtureDensity {
+		return invalidInput("modes and draws are only predicted by mixture networks", "NetworkRT")
+	}
+	return nil
+}
+
+// mixtureResults are the modes and draws the request asks for, of the mixtures predicted for the rows of x.
+func mixtureResults(request Request, structure *neuralnet.NNStructure, nn neuralnet.NeuralNetwork, x neuralnet.XSample) (modes neuralnet.YSample, draws []neuralnet.YSample) {
+	if !request.Modes && request.Draws == 0 {
+		return nil, nil
+	}
+	rnd := rand.New(rand.NewSource(request.Seed))
+	for _, xv := range x {
+		mixture := structure.MixtureOf(nn.Predict(xv))
+		if request.Modes {
+			modes = append(modes, mixture.Mode())
+		}
+		if request.Draws > 0 {
+			sample := make(neuralnet.YSample, request.Draws)
+			for i := range sample {
+				sample[i] = mixture.Sample(rnd)
+			}
+			draws = append(draws, sample)
 		}
 	}
+	return modes, draws
 }
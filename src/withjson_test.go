@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestServeJSONReportsErrorsAndContinues(t *testing.T) {
+	input := strings.Join([]string{
+		`{"Id": "a", "Order": {"D":2,"M":[],"K":3}}`,
+		`{"Id": "b", "Order": "x"}`,
+		`{"Order": {"D":2,"M":[4],"K":3}, bad`,
+		`{"Id": "c", "Order": {"D":2,"M":[4],"K":3}, "NetworkRT":"foo"}`,
+		`{"Id": "d", "Order": {"D":2,"M":[4],"K":3}}`,
+	}, "\n")
+
+	responses := runServeJSON(t, input, 1, false)
+	expectErrorResponse(t, responses[0], "a", InvalidInput, "Order.M")
+	expectErrorResponse(t, responses[1], "b", DecodeError, "Order")
+	expectErrorResponse(t, responses[2], "", DecodeError, "")
+	expectErrorResponse(t, responses[3], "c", InvalidInput, "NetworkRT")
+
+	result := Result{}
+	if err := json.Unmarshal(responses[4], &result); err != nil || result.Id != "d" || len(result.Wts) != 27 {
+		t.Errorf("expected a result for d, got %s", responses[4])
+	}
+}
+
+func TestServeJSONReportsEveryInvalidValue(t *testing.T) {
+	input := strings.Join([]string{
+		`{"Id": "a", "Order": {"D":2,"M":[4],"K":1}, "X": [[1, 2], [3]], "T": [[1], [2], [3]]}`,
+		`{"Id": "b", "Order": {"D":2,"M":[4],"K":1}, "X": [[1, 2]], "Strict": true}`,
+		`{"Id": "c", "Order": {"D":2,"M":[4],"K":1}, "NetworkRT": "quantile", "ResponseParams": {"Quantile": 2}}`,
+		`{"Id": "d", "Order": {"D":2,"M":[4],"K":1}, "X": [[1, 2], [3, 4]], "T": [[1], [2]], "SampleWeights": [1, -1, 0]}`,
+		`{"Id": "e", "Order": {"D":2,"M":[4],"K":2}, "X": [[1, 2], [3, 4]], "T": [[1, 2], [3, 4]], "TMask": [[true], [true, false]]}`,
+		`{"Id": "f", "Order": {"D":1,"M":[1],"K":1}, "Mask": ["frozen", "trainable", "pruned"]}`,
+	}, "\n")
+
+	responses := runServeJSON(t, input, 1, false)
+	expectErrorResponse(t, responses[0], "a", InvalidInput, "X")
+	expectProblems(t, responses[0], []string{"X[1]", "T"})
+	expectErrorResponse(t, responses[1], "b", InvalidInput, "Wts")
+	expectProblems(t, responses[1], []string{"Wts", "T"})
+	expectErrorResponse(t, responses[2], "c", InvalidInput, "ResponseParams.Quantile")
+	expectErrorResponse(t, responses[3], "d", InvalidInput, "SampleWeights")
+	expectProblems(t, responses[3], []string{"SampleWeights", "SampleWeights[1]"})
+	expectErrorResponse(t, responses[4], "e", InvalidInput, "TMask")
+	expectProblems(t, responses[4], []string{"TMask[0]"})
+	expectErrorResponse(t, responses[5], "f", InvalidInput, "Mask")
+	expectProblems(t, responses[5], []string{"Mask", "Mask[2]"})
+}
+
+func TestServeJSONFitsTrainableWeightsOnly(t *testing.T) {
+	input := `{"Id": "w", "Order": {"D":1,"M":[1],"K":1}, "Wts": [0.5, 0.1, 0.3, 0.2], "Mask": ["trainable", "frozen", "trainable", "absent"], "X": [[1], [2]], "T": [[1], [3]], "ShouldFit": true}`
+
+	result := Result{}
+	if err := json.Unmarshal(runServeJSON(t, input, 1, false)[0], &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Wts) != 4 || result.Wts[1] != 0.1 || result.Wts[3] != 0 || result.Wts[0] == 0.5 || result.Gradient[1] != 0 || result.Gradient[3] != 0 {
+		t.Errorf("expected only the trainable weights to change, got %+v", result)
+	}
+
+	responses := runServeJSON(t, strings.Join([]string{
+		`{"Id": "c", "Command": "create", "Model": "m", "Order": {"D":1,"M":[1],"K":1}, "Mask": ["trainable", "frozen", "trainable", "absent"]}`,
+		`{"Id": "f", "Command": "fit", "Model": "m", "Mask": ["trainable", "trainable", "trainable", "trainable"], "X": [[1]], "T": [[1]]}`,
+	}, "\n"), 1, true)
+	expectErrorResponse(t, responses[1], "f", InvalidInput, "Mask")
+}
+
+func TestServeJSONLeavesOutMaskedTargets(t *testing.T) {
+	request := `{"Id": "m", "Order": {"D":1,"M":[3],"K":2}, "Wts": [%s], "X": [[1], [2]], "T": [[1, %s], [%s, 3]]%s}`
+	weights := strings.TrimSuffix(strings.Repeat("0.1,", 14), ",")
+	input := strings.Join([]string{
+		fmt.Sprintf(request, weights, "2", "1", `, "TMask": [[true, false], [false, true]]`),
+		fmt.Sprintf(request, weights, "100", "-100", `, "TMask": [[true, false], [false, true]]`),
+		fmt.Sprintf(request, weights, "2", "1", ""),
+	}, "\n")
+
+	var erfs []float64
+	for _, raw := range runServeJSON(t, input, 1, false) {
+		result := Result{}
+		if err := json.Unmarshal(raw, &result); err != nil || result.ErfValue == nil {
+			t.Fatalf("expected a result, got %s", raw)
+		}
+		erfs = append(erfs, *result.ErfValue)
+	}
+	if erfs[0] != erfs[1] || erfs[0] >= erfs[2] {
+		t.Errorf("expected masked targets to add nothing to the error, got %v", erfs)
+	}
+}
+
+func TestServeJSONFitsClassLabels(t *testing.T) {
+	wts := make([]float64, 27)
+	for i := range wts {
+		wts[i] = float64(i%7)/7 - 0.5
+	}
+	input := fmt.Sprintf(`{"Id": "m", "ShouldFit": true, "NetworkRT": "multiclass", "Order": {"D":2,"M":[4],"K":3}, "Wts": %s, "X": [[1,0],[0,1],[-1,-1]], "T": [[0],[1],[2]]}`, mustJSON(t, wts))
+
+	result := Result{}
+	if err := json.Unmarshal(runServeJSON(t, input, 1, false)[0], &result); err != nil || len(result.Predicted) != 3 {
+		t.Fatalf("expected predictions for 3 samples: %v", err)
+	}
+	for i, y := range result.Predicted {
+		if len(y) != 3 || y[i] < 0.5 {
+			t.Errorf("expected class %d to be predicted, got %v", i, y)
+		}
+	}
+}
+
+func TestServeJSONPredictsStandardDeviations(t *testing.T) {
+	input := `{"Id": "g", "NetworkRT": "gaussian", "Order": {"D":2,"M":[4],"K":3}, "X": [[1,0],[0,1]], "T": [[0,1,2],[2,1,0]]}`
+
+	result := Result{}
+	if err := json.Unmarshal(runServeJSON(t, input, 1, false)[0], &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Wts) != 42 || len(result.Predicted) != 2 || len(result.Predicted[0]) != 3 || len(result.StdDev) != 2 || len(result.StdDev[1]) != 3 {
+		t.Errorf("expected 3 means and standard deviations per sample, got %+v", result)
+	}
+}
+
+func TestServeJSONPredictsMixtures(t *testing.T) {
+	input := strings.Join([]string{
+		`{"Id": "m", "NetworkRT": "mixture", "ResponseParams": {"Components": 2}, "Order": {"D":1,"M":[3],"K":2}, "X": [[1],[0]], "T": [[0,1],[2,1]], "Modes": true, "Draws": 5}`,
+		`{"Id": "g", "NetworkRT": "gaussian", "Order": {"D":1,"M":[3],"K":2}, "X": [[1]], "T": [[0,1]], "Draws": 5}`,
+	}, "\n")
+
+	responses := runServeJSON(t, input, 1, false)
+	result := Result{}
+	if err := json.Unmarshal(responses[0], &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Wts) != 3+3+3*8+8 || len(result.Predicted[1]) != 2 || len(result.StdDev[1]) != 2 || len(result.Modes) != 2 || len(result.Modes[0]) != 2 ||
+		len(result.Draws) != 2 || len(result.Draws[1]) != 5 || len(result.Draws[1][4]) != 2 {
+		t.Errorf("expected the means, standard deviations, modes and draws of 2 mixtures, got %s", responses[0])
+	}
+	expectErrorResponse(t, responses[1], "g", InvalidInput, "NetworkRT")
+}
+
+func TestServeJSONFitsTiedWeightsTogether(t *testing.T) {
+	input := `{"Id": "s", "Order": {"D":2,"M":[1],"K":1,"NoBias":true}, "Wts": [0.1, 0.5, 1], "Ties": [[0, 1]], "X": [[1, 0], [0, 1], [1, 1]], "T": [[1], [1], [2]], "ShouldFit": true}`
+
+	result := Result{}
+	if err := json.Unmarshal(runServeJSON(t, input, 1, false)[0], &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Wts) != 3 || result.Wts[0] != result.Wts[1] || result.Wts[0] == 0.1 || result.Gradient[0] != result.Gradient[1] {
+		t.Errorf("expected the inputs to share a fitted weight, got %+v", result)
+	}
+
+	input = `{"Id": "r", "Order": {"D":2,"M":[1],"K":1,"NoBias":true}, "Wts": [0.1, 0.5, 1], "Mask": ["trainable", "trainable", "frozen"], "Ties": [[99, 1]]}`
+	expectErrorResponse(t, runServeJSON(t, input, 1, false)[0], "r", InvalidInput, "Ties")
+
+	responses := runServeJSON(t, strings.Join([]string{
+		`{"Id": "c", "Command": "create", "Model": "m", "Order": {"D":2,"M":[1],"K":1,"NoBias":true}, "Ties": [[0, 1]]}`,
+		`{"Id": "p", "Command": "predict", "Model": "m", "Ties": [[1, 2]], "X": [[1, 0]]}`,
+	}, "\n"), 1, true)
+	expectErrorResponse(t, responses[1], "p", InvalidInput, "Ties")
+}
+
+func TestServeJSONConvolvesSequences(t *testing.T) {
+	input := `{"Id": "c", "Order": {"D":6,"M":[2],"K":1,"Convolutions":[{"Kernel":3,"Channels":2},{"Kernel":2,"Stride":2,"Pool":"max"}]}, "X": [[0,1,2,3,2,1]], "T": [[1]]}`
+
+	result := Result{}
+	if err := json.Unmarshal(runServeJSON(t, input, 1, false)[0], &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Wts) != 8+10+3 || len(result.Hidden[0]) != 8+4+2 {
+		t.Errorf("expected the weights and outputs of the convolutions, got %+v", result)
+	}
+}
+
+func TestServeJSONTakesSequences(t *testing.T) {
+	input := strings.Join([]string{
+		`{"Id": "r", "Order": {"D":2,"M":[3],"K":1,"Recurrent":{"EveryStep":true}}, "XSequences": [[[1,0],[0,1],[1,1]], [[0,0]]], "TSequences": [[[1],[2],[3]], [[0]]]}`,
+		`{"Id": "x", "Order": {"D":2,"M":[3],"K":1,"Recurrent":{}}, "X": [[1,0]], "XSequences": [[[1,0]]]}`,
+	}, "\n")
+
+	responses := runServeJSON(t, input, 1, false)
+	result := Result{}
+	if err := json.Unmarshal(responses[0], &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Wts) != 9+4+9 || len(result.Predicted[0]) != 3 || len(result.Predicted[1]) != 1 {
+		t.Errorf("expected an output for every step, got %+v", result)
+	}
+	expectErrorResponse(t, responses[1], "x", InvalidInput, "XSequences")
+}
+
+func TestServeJSONKeepsInputOrderWhenAsked(t *testing.T) {
+	var lines []string
+	ids := []string{"1", "2", "3", "4", "5", "6", "7", "8"}
+	for i, id := range ids {
+		fit := "false"
+		if i%2 == 0 {
+			fit = "true"
+		}
+		lines = append(lines, `{"Id": "`+id+`", "ShouldFit": `+fit+`, "Order": {"D":2,"M":[3,2],"K":3}}`)
+	}
+
+	responses := runServeJSON(t, strings.Join(lines, "\n"), 4, true)
+	for i, id := range ids {
+		result := Result{}
+		if err := json.Unmarshal(responses[i], &result); err != nil || result.Id != id {
+			t.Errorf("expected result %d to have id %s, got %s", i, id, responses[i])
+		}
+	}
+}
+
+func TestServeJSONAnswersEveryRequestConcurrently(t *testing.T) {
+	var lines []string
+	for i := 0; i < 10; i++ {
+		lines = append(lines, `{"Id": "`+string(rune('a'+i))+`", "ShouldFit": true, "Order": {"D":2,"M":[4],"K":3}}`)
+	}
+
+	responses := runServeJSON(t, strings.Join(lines, "\n"), 3, false)
+	seen := map[string]bool{}
+	for _, response := range responses {
+		result := Result{}
+		if err := json.Unmarshal(response, &result); err != nil {
+			t.Fatalf("can't decode result: %v", err)
+		}
+		seen[result.Id] = true
+	}
+	if len(seen) != len(lines) {
+		t.Errorf("expected %d distinct ids, got %v", len(lines), seen)
+	}
+}
+
+func TestServeJSONKeepsModelsAndDatasetsBetweenRequests(t *testing.T) {
+	input := strings.Join([]string{
+		`{"Id": "1", "Command": "create", "Model": "m", "Order": {"D":2,"M":[3,2],"K":3}}`,
+		`{"Id": "2", "Command": "create", "Dataset": "d", "X": [[1,1],[1,2],[2,1]], "T": [[1,2,3],[3,2,3],[3,2,1]]}`,
+		`{"Id": "3", "Command": "gradient", "Model": "m", "Dataset": "d"}`,
+		`{"Id": "4", "Command": "fit", "Model": "m", "Dataset": "d"}`,
+		`{"Id": "5", "Command": "gradient", "Model": "m", "Dataset": "d"}`,
+		`{"Id": "6", "Command": "predict", "Model": "m", "X": [[1,1]]}`,
+		`{"Id": "7", "Command": "delete", "Model": "m", "Dataset": "d"}`,
+		`{"Id": "8", "Command": "predict", "Model": "m", "X": [[1,1]]}`,
+		`{"Id": "9", "Command": "gradient", "Model": "m"}`,
+		`{"Id": "10", "Command": "train", "Model": "m"}`,
+	}, "\n")
+
+	responses := runServeJSON(t, input, 1, false)
+	results := make([]Result, 7)
+	for i := range results {
+		if err := json.Unmarshal(responses[i], &results[i]); err != nil || results[i].Id != fmt.Sprint(i+1) {
+			t.Fatalf("expected result %d, got %s", i+1, responses[i])
+		}
+	}
+
+	if len(results[0].Wts) != 26 || results[0].Model != "m" {
+		t.Errorf("expected the created model with default weights, got %s", responses[0])
+	}
+	if *results[2].ErfValue <= *results[4].ErfValue {
+		t.Errorf("expected fit to improve the stored model: %f <= %f", *results[2].ErfValue, *results[4].ErfValue)
+	}
+	if *results[3].ErfValue != *results[4].ErfValue {
+		t.Errorf("expected gradient to use the fitted weights: %f != %f", *results[3].ErfValue, *results[4].ErfValue)
+	}
+	if len(results[5].Predicted) != 1 || results[5].Gradient != nil {
+		t.Errorf("expected a single prediction, got %s", responses[5])
+	}
+	expectErrorResponse(t, responses[7], "8", InvalidInput, "Model")
+	expectErrorResponse(t, responses[8], "9", InvalidInput, "Model")
+	expectErrorResponse(t, responses[9], "10", InvalidInput, "Command")
+}
+
+func TestServeJSONReportsProgressBeforeResult(t *testing.T) {
+	input := `{"Id": "p", "ShouldFit": true, "ProgressEvery": 10, "Order": {"D":2,"M":[3,2],"K":3}, "X": [[1,1],[1,2],[2,1]], "T": [[1,2,3],[3,2,3],[3,2,1]]}`
+
+	responses := runServeJSON(t, input, 1, false)
+	if len(responses) < 3 {
+		t.Fatalf("expected progress messages before the result, got %d responses", len(responses))
+	}
+	for i, raw := range responses[:len(responses)-1] {
+		message := ProgressMessage{}
+		if err := json.Unmarshal(raw, &message); err != nil || message.Id != "p" || message.Progress.Iteration != 10*(i+1) {
+			t.Errorf("expected progress after iteration %d, got %s", 10*(i+1), raw)
+		}
+	}
+	result := Result{}
+	if err := json.Unmarshal(responses[len(responses)-1], &result); err != nil || result.Wts == nil {
+		t.Errorf("expected the result last, got %s", responses[len(responses)-1])
+	}
+}
+
+func TestServeJSONCancelsRunningFit(t *testing.T) {
+	inW, started, responses := pipeServeJSON(2)
+
+	io.WriteString(inW, `{"Id": "long", "ShouldFit": true, "ProgressEvery": 1, "Order": {"D":2,"M":[30,30],"K":3}, "X": [[1,1],[1,2],[2,1]], "T": [[1,2,3],[3,2,3],[3,2,1]]}`+"\n")
+	<-started
+	io.WriteString(inW, `{"Id": "stop", "Command": "cancel", "Cancel": "long"}`+"\n")
+	io.WriteString(inW, `{"Id": "again", "Command": "cancel", "Cancel": "nothing"}`+"\n")
+	inW.Close()
+
+	var cancelled *Result
+	acknowledged := false
+	for _, raw := range <-responses {
+		result := Result{}
+		json.Unmarshal(raw, &result)
+		switch {
+		case result.Id == "stop":
+			acknowledged = true
+		case result.Id == "again":
+			expectErrorResponse(t, raw, "again", InvalidInput, "Cancel")
+		case result.Id == "long" && result.Wts != nil:
+			cancelled = &result
+		}
+	}
+
+	if !acknowledged {
+		t.Errorf("expected the cancel to be acknowledged")
+	}
+	if cancelled == nil || !cancelled.Cancelled || len(cancelled.Wts) != 1113 {
+		t.Errorf("expected the best weights so far flagged as cancelled, got %+v", cancelled)
+	}
+}
+
+func TestServeJSONCancelsWhileRequestsAreQueued(t *testing.T) {
+	inW, started, responses := pipeServeJSON(1)
+
+	io.WriteString(inW, `{"Id": "long", "ShouldFit": true, "ProgressEvery": 1, "Options": {"MaxIter": 100000, "ErfTol": 1e-300}, "Order": {"D":2,"M":[30,30],"K":3}, "X": [[1,1],[1,2],[2,1]], "T": [[1,2,3],[3,2,3],[3,2,1]]}`+"\n")
+	<-started
+	io.WriteString(inW, `{"Id": "queued", "Order": {"D":2,"M":[4],"K":3}}`+"\n")
+	io.WriteString(inW, `{"Id": "stop", "Command": "cancel", "Cancel": "long"}`+"\n")
+	inW.Close()
+
+	answered := map[string]json.RawMessage{}
+	for _, raw := range <-responses {
+		result := Result{}
+		json.Unmarshal(raw, &result)
+		if result.Id != "long" || result.Wts != nil {
+			answered[result.Id] = raw
+		}
+	}
+
+	result := Result{}
+	if err := json.Unmarshal(answered["stop"], &result); err != nil || result.Id != "stop" {
+		t.Errorf("expected the cancel to reach the running fit past the queued request, got %s", answered["stop"])
+	}
+	if err := json.Unmarshal(answered["long"], &result); err != nil || !result.Cancelled {
+		t.Errorf("expected the fit to be cancelled, got %s", answered["long"])
+	}
+	if err := json.Unmarshal(answered["queued"], &result); err != nil || result.Wts == nil {
+		t.Errorf("expected the queued request to be served after the fit, got %s", answered["queued"])
+	}
+}
+
+// pipeServeJSON serves the requests written to in, and sends all responses once in is closed. started is closed
+// with the first response.
+func pipeServeJSON(workers int) (in io.WriteCloser, started <-chan struct{}, responses <-chan []json.RawMessage) {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	go func() {
+		serveJSON(inR, outW, workers, false)
+		outW.Close()
+	}()
+
+	first := make(chan struct{})
+	all := make(chan []json.RawMessage)
+	go func() {
+		var received []json.RawMessage
+		dec := json.NewDecoder(outR)
+		for {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				all <- received
+				return
+			}
+			if len(received) == 0 {
+				close(first)
+			}
+			received = append(received, raw)
+		}
+	}()
+	return inW, first, all
+}
+
+func TestServeJSONEchoesEffectiveOptions(t *testing.T) {
+	input := strings.Join([]string{
+		`{"Id": "a", "ShouldFit": true, "Order": {"D":2,"M":[4],"K":3}, "Options": {"MaxIter": 3, "InitialEta": 0.5}}`,
+		`{"Id": "b", "ShouldFit": true, "Order": {"D":2,"M":[4],"K":3}, "Options": {"LineSearchSteps": -1}}`,
+		`{"Id": "c", "Order": {"D":2,"M":[4],"K":3}}`,
+	}, "\n")
+
+	responses := runServeJSON(t, input, 1, false)
+	result := Result{}
+	if err := json.Unmarshal(responses[0], &result); err != nil || result.Options == nil {
+		t.Fatalf("expected the options in the result, got %s", responses[0])
+	}
+	expected := Options{1e-12, 3, 0, 0.5, 15}
+	if *result.Options != expected {
+		t.Errorf("expected options %+v, got %+v", expected, *result.Options)
+	}
+	expectErrorResponse(t, responses[1], "b", InvalidInput, "Options.LineSearchSteps")
+
+	result = Result{}
+	if err := json.Unmarshal(responses[2], &result); err != nil || result.Options != nil {
+		t.Errorf("expected no options without fitting, got %s", responses[2])
+	}
+}
+
+func runServeJSON(t *testing.T, input string, workers int, ordered bool) []json.RawMessage {
+	out := &bytes.Buffer{}
+	serveJSON(strings.NewReader(input), out, workers, ordered)
+
+	var responses []json.RawMessage
+	dec := json.NewDecoder(out)
+	for {
+		var response json.RawMessage
+		if err := dec.Decode(&response); err == io.EOF {
+			return responses
+		} else if err != nil {
+			t.Fatalf("can't decode response: %v", err)
+		}
+		responses = append(responses, response)
+	}
+}
+
+func expectErrorResponse(t *testing.T, raw json.RawMessage, id string, code string, field string) {
+	response := ErrorResponse{}
+	if err := json.Unmarshal(raw, &response); err != nil {
+		t.Fatalf("can't decode error response: %v", err)
+	}
+	if response.Id != id || response.Error.Code != code || response.Error.Field != field {
+		t.Errorf("expected error %s on %q for %q, got %s", code, field, id, raw)
+	}
+}
+
+func expectProblems(t *testing.T, raw json.RawMessage, positions []string) {
+	response := ErrorResponse{}
+	if err := json.Unmarshal(raw, &response); err != nil {
+		t.Fatalf("can't decode error response: %v", err)
+	}
+	var got []string
+	for _, p := range response.Error.Problems {
+		position := p.Field
+		if p.Row != nil {
+			position += fmt.Sprintf("[%d]", *p.Row)
+		}
+		if p.Col != nil {
+			position += fmt.Sprintf("[%d]", *p.Col)
+		}
+		got = append(got, position)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(positions) {
+		t.Errorf("expected problems at %v, got %s", positions, raw)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encoded)
+}